@@ -0,0 +1,90 @@
+package servertiming
+
+import (
+	"context"
+	"io"
+)
+
+// Names of the metrics recorded by MiddlewareOpts.CaptureBodyRead and
+// MiddlewareOpts.CaptureBodyWrite.
+const (
+	bodyReadMetricName  = "req-read"
+	bodyWriteMetricName = "resp-write"
+)
+
+// timedReadCloser wraps a request body and records the total time spent
+// blocked in Read into a metric on the header. The metric is only added
+// once the body is first read.
+type timedReadCloser struct {
+	io.ReadCloser
+
+	h    *Header
+	name string
+	m    *Metric
+}
+
+func (r *timedReadCloser) Read(p []byte) (int, error) {
+	start := now()
+	n, err := r.ReadCloser.Read(p)
+	d := now().Sub(start)
+
+	// The duration is updated under the header lock since the header may
+	// be written concurrently with a read.
+	r.h.Lock()
+	defer r.h.Unlock()
+	if r.m == nil {
+		r.m = r.h.add(&Metric{Name: r.name})
+	}
+	r.m.Duration += d
+
+	return n, err
+}
+
+// TimeReader returns an io.Reader that reads from r and records the time
+// spent reading it as a metric in the *Header in ctx. The metric is
+// created with NewMetricFromContext and started on the first Read, so
+// nothing is recorded if r is never read. It is stopped once r returns
+// io.EOF, or when the returned reader is closed, whichever comes first.
+//
+// The returned reader also implements io.Closer. Close stops the metric
+// and closes r if r implements io.Closer. This is useful to time reading
+// an upstream response body or a stream without starting and stopping a
+// metric around each Read call. To time the request body of every
+// request, use MiddlewareOpts.CaptureBodyRead instead.
+func TimeReader(ctx context.Context, name string, r io.Reader) io.Reader {
+	return &timeReader{Reader: r, ctx: ctx, name: name}
+}
+
+// timeReader is the io.Reader returned by TimeReader.
+type timeReader struct {
+	io.Reader
+
+	ctx  context.Context
+	name string
+	m    *Metric
+}
+
+func (r *timeReader) Read(p []byte) (int, error) {
+	if r.m == nil {
+		r.m = NewMetricFromContext(r.ctx, r.name).Start()
+	}
+
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.m.StopUnlessStopped()
+	}
+
+	return n, err
+}
+
+func (r *timeReader) Close() error {
+	if r.m != nil {
+		r.m.StopUnlessStopped()
+	}
+
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package servertiming
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// slowReader sleeps before each Read of the wrapped reader.
+type slowReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return r.Reader.Read(p)
+}
+
+func (r *slowReader) Close() error {
+	r.closed = true
+	return errors.New("closed")
+}
+
+func TestTimeReader(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	r := TimeReader(ctx, "body", iotest.OneByteReader(&slowReader{Reader: strings.NewReader("hello")}))
+	if len(h.Metrics) != 0 {
+		t.Fatalf("metric should not be added before the first read: %#v", h.Metrics)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("bad: %q", data)
+	}
+
+	if len(h.Metrics) != 1 {
+		t.Fatalf("expected one metric: %#v", h.Metrics)
+	}
+	m := h.Metrics[0]
+	if m.Name != "body" || !m.Measured() || m.Duration < 5*time.Millisecond {
+		t.Fatalf("bad metric: %#v", m)
+	}
+
+	// Close after EOF doesn't change the recorded duration.
+	d := m.Duration
+	time.Sleep(time.Millisecond)
+	r.(io.Closer).Close()
+	if m.Duration != d {
+		t.Fatalf("duration changed after close: %s != %s", m.Duration, d)
+	}
+}
+
+func TestTimeReader_close(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	sr := &slowReader{Reader: strings.NewReader("hello")}
+	r := TimeReader(ctx, "body", sr)
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(h.Metrics) != 1 || h.Metrics[0].Measured() {
+		t.Fatalf("metric should be started but not stopped: %#v", h.Metrics)
+	}
+
+	if err := r.(io.Closer).Close(); err == nil || err.Error() != "closed" {
+		t.Fatalf("expected error of underlying reader: %v", err)
+	}
+	if !sr.closed {
+		t.Fatal("underlying reader should be closed")
+	}
+	if !h.Metrics[0].Measured() {
+		t.Fatalf("metric should be stopped: %#v", h.Metrics[0])
+	}
+}
+
+func TestTimeReader_unread(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	r := TimeReader(ctx, "body", strings.NewReader("hello"))
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(h.Metrics) != 0 {
+		t.Fatalf("unread reader should not add a metric: %#v", h.Metrics)
+	}
+}
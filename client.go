@@ -0,0 +1,160 @@
+package servertiming
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Names of the metrics recorded by Transport.ConnTrace.
+const (
+	dnsMetricName     = "dns"
+	connectMetricName = "connect"
+	tlsMetricName     = "tls"
+)
+
+// TimeRoundTrip performs the request with rt and records how long it took
+// as a metric with the given name in the *Header in ctx. If rt is nil,
+// http.DefaultTransport is used. If the round trip fails, the metric is
+// annotated with WithError. The metric is created with NewMetricFromContext,
+// so it gets the tags and description prefix set on ctx.
+//
+// The Server-Timing header of the response, if any, is not merged into
+// the current header. Use Header.AppendFromString with the response header
+// to do that.
+func TimeRoundTrip(ctx context.Context, name string, rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	m := NewMetricFromContext(ctx, name).Start()
+	resp, err := rt.RoundTrip(req)
+	m.Stop().WithError(err)
+	return resp, err
+}
+
+// Transport is an http.RoundTripper that records a metric for every
+// request it performs in the *Header in the request context. This allows
+// an http.Client to time all of its requests without wrapping each call
+// site with TimeRoundTrip:
+//
+//	client := &http.Client{Transport: &servertiming.Transport{}}
+//	req = req.WithContext(r.Context())
+//	resp, err := client.Do(req)
+//
+// Requests whose context has no *Header are performed without recording.
+type Transport struct {
+	// Base is the RoundTripper used to perform the requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// Name returns the metric name for a request. The name must be a
+	// valid token, see Metric.Name. If nil, the host name of the request
+	// URL is used, with any characters that aren't valid in a token, such
+	// as the colons of an IPv6 address, replaced by "-".
+	Name func(*http.Request) string
+
+	// ConnTrace additionally records how long the DNS lookup, TCP connect
+	// and TLS handshake of a request took as the "dns", "connect" and
+	// "tls" metrics, with the name of the request metric as description.
+	// This shows where the time of a slow request went, which the single
+	// metric of the round trip hides. The metrics are only recorded for
+	// the steps that actually happen, so a request on a reused connection
+	// records none of them.
+	ConnTrace bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := hostMetricName(req.URL.Hostname())
+	if t.Name != nil {
+		name = t.Name(req)
+	}
+
+	if h := FromContext(req.Context()); h != nil && t.ConnTrace {
+		ct := &connTrace{ctx: req.Context(), desc: name}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), ct.clientTrace()))
+		defer ct.finish()
+	}
+
+	return TimeRoundTrip(req.Context(), name, t.Base, req)
+}
+
+// hostMetricName returns host as a valid metric name for Transport. Host
+// names are valid tokens already, but IPv6 addresses are not.
+func hostMetricName(host string) string {
+	if isToken(host) {
+		return host
+	}
+
+	b := []byte(host)
+	for i, c := range b {
+		if !isTokenChar(c) {
+			b[i] = '-'
+		}
+	}
+
+	return string(b)
+}
+
+// connTrace records the metrics of Transport.ConnTrace. The hooks of
+// httptrace.ClientTrace may be called concurrently, such as when dialing
+// multiple addresses, so the metrics are guarded by mu.
+//
+// The hooks can also be called after the round trip returned, such as
+// when a dial that wasn't needed finishes in the background. By then the
+// header may be written, so nothing is recorded once done is set.
+type connTrace struct {
+	mu   sync.Mutex
+	ctx  context.Context
+	desc string
+	done bool
+
+	dns, connect, tls *Metric
+}
+
+func (c *connTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { c.start(&c.dns, dnsMetricName) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { c.stop(&c.dns) },
+
+		// With multiple addresses only the first attempt starts the
+		// metric and the first successful one stops it.
+		ConnectStart: func(string, string) { c.start(&c.connect, connectMetricName) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				c.stop(&c.connect)
+			}
+		},
+
+		TLSHandshakeStart: func() { c.start(&c.tls, tlsMetricName) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { c.stop(&c.tls) },
+	}
+}
+
+// start adds and starts the metric in m if it wasn't already.
+func (c *connTrace) start(m **Metric, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *m == nil && !c.done {
+		*m = NewMetricFromContext(c.ctx, name).WithDesc(c.desc).Start()
+	}
+}
+
+// stop stops the metric in m if it was started and not stopped yet.
+func (c *connTrace) stop(m **Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *m != nil && !c.done {
+		(*m).StopUnlessStopped()
+	}
+}
+
+// finish stops recording once the round trip returned.
+func (c *connTrace) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+}
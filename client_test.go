@@ -0,0 +1,256 @@
+package servertiming
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundTripFunc implements http.RoundTripper with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTimeRoundTrip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := TimeRoundTrip(ctx, "api", nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(h.Metrics) != 1 {
+		t.Fatalf("expected one metric: %#v", h.Metrics)
+	}
+	m := h.Metrics[0]
+	if m.Name != "api" || m.Duration < 10*time.Millisecond {
+		t.Fatalf("bad metric: %#v", m)
+	}
+	if _, ok := m.Extra[paramNameError]; ok {
+		t.Fatalf("should not have error: %#v", m)
+	}
+}
+
+func TestTimeRoundTrip_context(t *testing.T) {
+	rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	var h Header
+	ctx := WithMetricTag(NewContext(context.Background(), &h), "op", "sync")
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TimeRoundTrip(ctx, "api", rt, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Metrics) != 1 || h.Metrics[0].Extra["op"] != "sync" {
+		t.Fatalf("expected a tagged metric: %#v", h.Metrics)
+	}
+}
+
+func TestTimeRoundTrip_error(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("boom")
+	})
+	if _, err := TimeRoundTrip(ctx, "api", rt, req); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(h.Metrics) != 1 || h.Metrics[0].Extra[paramNameError] != "true" {
+		t.Fatalf("expected error metric: %#v", h.Metrics)
+	}
+}
+
+func TestTimeRoundTrip_noHeader(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	if _, err := TimeRoundTrip(context.Background(), "api", rt, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	cases := []struct {
+		Name     string
+		URL      string
+		NameFunc func(*http.Request) string
+		Expected string
+	}{
+		{
+			"default name",
+			"http://api.example.com:8080/users/1",
+			nil,
+			"api.example.com",
+		},
+
+		{
+			"ipv6 host",
+			"http://[::1]:8080/users/1",
+			nil,
+			"--1",
+		},
+
+		{
+			"name func",
+			"http://api.example.com:8080/users/1",
+			func(r *http.Request) string { return "users-" + r.Method },
+			"users-GET",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			var h Header
+			req, err := http.NewRequest("GET", tt.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = req.WithContext(NewContext(context.Background(), &h))
+
+			client := &http.Client{Transport: &Transport{Base: rt, Name: tt.NameFunc}}
+			if _, err := client.Do(req); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(h.Metrics) != 1 {
+				t.Fatalf("expected one metric: %#v", h.Metrics)
+			}
+			if m := h.Metrics[0]; m.Name != tt.Expected || !m.Measured() {
+				t.Fatalf("bad metric: %#v", m)
+			}
+			if err := h.Validate(); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		})
+	}
+}
+
+func TestTransport_connTrace(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	do := func(h *Header, rt http.RoundTripper) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := WithDescPrefix(NewContext(context.Background(), h), "conn ")
+		req = req.WithContext(ctx)
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	rt := &Transport{
+		Base:      ts.Client().Transport,
+		Name:      func(*http.Request) string { return "api" },
+		ConnTrace: true,
+	}
+
+	var h Header
+	do(&h, rt)
+
+	// The server URL is an IP address so there is no DNS lookup.
+	var names []string
+	for _, m := range h.Metrics {
+		names = append(names, m.Name)
+		if m.Name != "api" && (m.Desc != "conn api" || !m.Measured()) {
+			t.Fatalf("bad metric: %#v", m)
+		}
+	}
+	if expected := []string{"api", "connect", "tls"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", names, expected)
+	}
+
+	// A reused connection records no connection metrics.
+	var h2 Header
+	do(&h2, rt)
+	if len(h2.Metrics) != 1 || h2.Metrics[0].Name != "api" {
+		t.Fatalf("expected only the request metric: %#v", h2.Metrics)
+	}
+}
+
+func TestConnTrace_finish(t *testing.T) {
+	var h Header
+	ct := &connTrace{ctx: NewContext(context.Background(), &h), desc: "api"}
+	trace := ct.clientTrace()
+
+	// Hooks called after the round trip returned don't record anything
+	trace.ConnectStart("tcp", "127.0.0.1:80")
+	ct.finish()
+	trace.ConnectDone("tcp", "127.0.0.1:80", nil)
+	trace.DNSStart(httptrace.DNSStartInfo{Host: "example.com"})
+
+	if len(h.Metrics) != 1 || h.Metrics[0].Name != connectMetricName {
+		t.Fatalf("expected only the connect metric: %#v", h.Metrics)
+	}
+	if !h.Metrics[0].Running() {
+		t.Fatalf("metric should not be stopped: %#v", h.Metrics[0])
+	}
+}
+
+func TestTransport_connTraceDisabled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var h Header
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(NewContext(context.Background(), &h))
+
+	resp, err := (&Transport{Base: &http.Transport{}}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(h.Metrics) != 1 {
+		t.Fatalf("expected one metric: %#v", h.Metrics)
+	}
+}
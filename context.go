@@ -2,6 +2,8 @@ package servertiming
 
 import (
 	"context"
+	"net"
+	"sync/atomic"
 )
 
 // NewContext returns a new Context that carries the Header value h.
@@ -16,8 +18,171 @@ func FromContext(ctx context.Context) *Header {
 	return h
 }
 
+// NewContextWithKey returns a new Context that carries the Header value h
+// under the given key. This is for applications that need to look up the
+// *Header with their own key. Most users should use NewContext.
+func NewContextWithKey(ctx context.Context, key interface{}, h *Header) context.Context {
+	return context.WithValue(ctx, key, h)
+}
+
+// FromContextWithKey returns the *Header in the context stored under the
+// given key, if any. If no Header value exists, nil is returned.
+func FromContextWithKey(ctx context.Context, key interface{}) *Header {
+	h, _ := ctx.Value(key).(*Header)
+	return h
+}
+
+// WithMetricTag returns a new Context that carries the tag key=value.
+// Metrics created with NewMetricFromContext using the returned context, or
+// any context derived from it, have the tag set as an extra param. This
+// annotates all the metrics of an operation, such as with its ID, without
+// passing the tag to every function that records a metric.
+//
+// Tags from parent contexts are kept. Setting a key that a parent context
+// already set overrides its value.
+func WithMetricTag(ctx context.Context, key, value string) context.Context {
+	parent, _ := ctx.Value(tagsKey).(map[string]string)
+	tags := make(map[string]string, len(parent)+1)
+	for k, v := range parent {
+		tags[k] = v
+	}
+	tags[key] = value
+
+	return context.WithValue(ctx, tagsKey, tags)
+}
+
+// WithDescPrefix returns a new Context that carries a description prefix.
+// Metrics created with NewMetricFromContext using the returned context, or
+// any context derived from it, have the prefix prepended to descriptions
+// set with WithDesc. This attributes metrics to a subsystem without
+// passing its name to every WithDesc call. Metrics without a description
+// are not affected.
+//
+// A prefix set on a parent context is kept in front of prefix.
+func WithDescPrefix(ctx context.Context, prefix string) context.Context {
+	parent, _ := ctx.Value(descPrefixKey).(string)
+	return context.WithValue(ctx, descPrefixKey, parent+prefix)
+}
+
+// NewMetricFromContext creates a new Metric and adds it to the *Header in
+// ctx, like Header.NewMetric. Any tags set with WithMetricTag are added to
+// the Extra field of the metric and any prefix set with WithDescPrefix is
+// used by WithDesc. If there is no *Header in ctx, the metric is not
+// recorded.
+func NewMetricFromContext(ctx context.Context, name string) *Metric {
+	m := &Metric{Name: name}
+	m.descPrefix, _ = ctx.Value(descPrefixKey).(string)
+	if tags, ok := ctx.Value(tagsKey).(map[string]string); ok {
+		m.Annotate(tags)
+	}
+
+	return FromContext(ctx).Add(m)
+}
+
+// Measure calls fn and records how long it took as a metric with the
+// given name in the *Header in ctx. The metric is created with
+// NewMetricFromContext and is stopped even if fn panics. If there is no
+// *Header in ctx, fn is called without recording anything.
+//
+// Together with NewContext and FromContext, this doesn't need the
+// Middleware, so it also works for code outside of an HTTP request, such
+// as a background job that logs a summary of its steps:
+//
+//	var h servertiming.Header
+//	ctx = servertiming.NewContext(ctx, &h)
+//	servertiming.Measure(ctx, "fetch", fetch)
+//	servertiming.Measure(ctx, "process", process)
+//	log.Println(h.String())
+func Measure(ctx context.Context, name string, fn func()) {
+	m := NewMetricFromContext(ctx, name).Start()
+	defer m.Stop()
+
+	fn()
+}
+
+// Go calls fn in a new goroutine and records how long it took as a metric
+// with the given name in the *Header in ctx. The metric is created with
+// NewMetricFromContext before the goroutine starts, so it is in the header
+// in the order Go was called. fn is passed ctx so it can record metrics of
+// its own.
+//
+// As with any metric, fn must return before the header is written, such
+// as by waiting for it in the handler with a sync.WaitGroup that fn marks
+// as done. The metric is stopped right after fn returns, so the Middleware
+// waits for the metrics of goroutines started with Go to be stopped before
+// it writes the header. Without the Middleware, call Measure in a goroutine
+// of your own instead, so that waiting for it includes stopping the metric.
+func Go(ctx context.Context, name string, fn func(context.Context)) {
+	h := FromContext(ctx)
+	m := NewMetricFromContext(ctx, name).Start()
+	if h != nil {
+		h.pending.Add(1)
+	}
+
+	go func() {
+		if h != nil {
+			defer h.pending.Done()
+		}
+		defer m.Stop()
+
+		fn(ctx)
+	}()
+}
+
+// DisableForRequest marks the *Header in the context so that the
+// Middleware doesn't write the Server-Timing header for this request. The
+// metrics are still recorded. This is useful when the decision to send
+// timings depends on how the request was handled, such as skipping
+// responses served from a cache.
+//
+// This must be called before the response header is written to have an
+// effect. If the context has no *Header, this does nothing.
+func DisableForRequest(ctx context.Context) {
+	if h := FromContext(ctx); h != nil {
+		h.Lock()
+		defer h.Unlock()
+		h.disabled = true
+	}
+}
+
+// ConnContext returns a new Context that tracks the number of requests
+// served on the connection c. Set it as the ConnContext field of an
+// http.Server to enable MiddlewareOpts.CaptureCold:
+//
+//	srv := &http.Server{
+//		Handler:     servertiming.Middleware(handler, opts),
+//		ConnContext: servertiming.ConnContext,
+//	}
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey, new(int64))
+}
+
+// firstOnConn reports whether the request with the context ctx is the
+// first one on its connection. Every call counts as a request, so this
+// must be called only once per request. If the connection isn't tracked
+// with ConnContext, this is always false.
+func firstOnConn(ctx context.Context) bool {
+	n, ok := ctx.Value(connKey).(*int64)
+	return ok && atomic.AddInt64(n, 1) == 1
+}
+
 type contextKeyType struct{}
 
 // The key where the header value is stored. This is globally unique since
 // it uses a custom unexported type. The struct{} costs zero allocations.
 var contextKey = contextKeyType(struct{}{})
+
+type tagsKeyType struct{}
+
+// The key where the tags from WithMetricTag are stored.
+var tagsKey = tagsKeyType(struct{}{})
+
+type descPrefixKeyType struct{}
+
+// The key where the prefix from WithDescPrefix is stored.
+var descPrefixKey = descPrefixKeyType(struct{}{})
+
+type connKeyType struct{}
+
+// The key where the request counter from ConnContext is stored.
+var connKey = connKeyType(struct{}{})
@@ -2,7 +2,11 @@ package servertiming
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestContext(t *testing.T) {
@@ -20,3 +24,186 @@ func TestContext_notSet(t *testing.T) {
 		t.Fatal("h should be nil")
 	}
 }
+
+func TestContext_wrongType(t *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey, "not a header")
+	if h := FromContext(ctx); h != nil {
+		t.Fatal("h should be nil")
+	}
+
+	type customKey struct{}
+	ctx = context.WithValue(context.Background(), customKey{}, 42)
+	if h := FromContextWithKey(ctx, customKey{}); h != nil {
+		t.Fatal("h should be nil")
+	}
+}
+
+func TestContextWithKey(t *testing.T) {
+	type customKey struct{}
+
+	h := new(Header)
+	ctx := NewContextWithKey(context.Background(), customKey{}, h)
+	if h2 := FromContextWithKey(ctx, customKey{}); h != h2 {
+		t.Fatal("should have stored value")
+	}
+	if h2 := FromContext(ctx); h2 != nil {
+		t.Fatal("should not be stored under the default key")
+	}
+}
+
+func TestDisableForRequest(t *testing.T) {
+	h := new(Header)
+	DisableForRequest(NewContext(context.Background(), h))
+	if !h.disabled {
+		t.Fatal("should be disabled")
+	}
+
+	// Without a header this is a no-op
+	DisableForRequest(context.Background())
+}
+
+func TestWithMetricTag(t *testing.T) {
+	h := new(Header)
+	ctx := NewContext(context.Background(), h)
+	ctx = WithMetricTag(ctx, "op", "1")
+	child := WithMetricTag(ctx, "step", "load")
+	override := WithMetricTag(child, "op", "2")
+
+	NewMetricFromContext(ctx, "a")
+	NewMetricFromContext(child, "b")
+	NewMetricFromContext(override, "c")
+
+	expected := `a;op=1,b;op=1;step=load,c;op=2;step=load`
+	if actual := h.StringOpts(&EncodeOpts{SortExtra: true}); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestNewMetricFromContext_noTags(t *testing.T) {
+	h := new(Header)
+	m := NewMetricFromContext(NewContext(context.Background(), h), "sql")
+	if len(h.Metrics) != 1 || h.Metrics[0] != m || m.Extra != nil {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+
+	// Without a header the metric is not recorded
+	if m := NewMetricFromContext(context.Background(), "sql"); m == nil {
+		t.Fatal("should return a metric")
+	}
+}
+
+func TestWithDescPrefix(t *testing.T) {
+	h := new(Header)
+	ctx := WithDescPrefix(NewContext(context.Background(), h), "cache: ")
+	child := WithDescPrefix(ctx, "redis ")
+
+	NewMetricFromContext(ctx, "a").WithDesc("lookup")
+	NewMetricFromContext(child, "b").WithDesc("get")
+	NewMetricFromContext(ctx, "c")
+	NewMetricFromContext(ctx, "d").WithDesc("")
+	h.NewMetric("e").WithDesc("plain")
+
+	expected := `a;desc="cache: lookup",b;desc="cache: redis get",c,d,e;desc=plain`
+	if actual := h.String(); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	cur := time.Unix(0, 0)
+	setNow(t, func() time.Time { return cur })
+
+	// A background job recording its steps without the Middleware
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+	for i := 0; i < 2; i++ {
+		Measure(ctx, "fetch", func() { cur = cur.Add(20 * time.Millisecond) })
+		Measure(WithMetricTag(ctx, "batch", "1"), "process", func() {
+			cur = cur.Add(5 * time.Millisecond)
+			FromContext(ctx).AddDuration("cache", time.Millisecond)
+		})
+	}
+	h.Dedup()
+
+	expected := "fetch;dur=40;count=2,process;dur=10;count=2;batch=1,cache;dur=2;count=2"
+	if actual := h.String(); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMeasure_panic(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	func() {
+		defer func() { recover() }()
+		Measure(ctx, "step", func() { panic("boom") })
+	}()
+
+	if len(h.Metrics) != 1 || !h.Metrics[0].Measured() {
+		t.Fatalf("metric should be stopped: %#v", h.Metrics)
+	}
+}
+
+func TestMeasure_noHeader(t *testing.T) {
+	called := false
+	Measure(context.Background(), "step", func() { called = true })
+	if !called {
+		t.Fatal("fn should be called")
+	}
+}
+
+func TestGo(t *testing.T) {
+	h := new(Header)
+	ctx := NewContext(context.Background(), h)
+
+	for _, name := range []string{"a", "b"} {
+		Go(ctx, name, func(ctx context.Context) {
+			time.Sleep(10 * time.Millisecond)
+			FromContext(ctx).NewMetric("inner")
+		})
+	}
+	h.pending.Wait()
+
+	if len(h.Metrics) != 4 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+	for i, name := range []string{"a", "b"} {
+		if m := h.Metrics[i]; m.Name != name || m.Duration < 10*time.Millisecond {
+			t.Fatalf("bad metric: %#v", m)
+		}
+	}
+}
+
+func TestGo_middleware(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		for _, name := range []string{"a", "b"} {
+			wg.Add(1)
+			Go(r.Context(), name, func(ctx context.Context) {
+				defer wg.Done()
+				time.Sleep(10 * time.Millisecond)
+			})
+		}
+
+		// The metrics may not be stopped yet, but the middleware waits
+		wg.Wait()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	Middleware(handler, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	h, err := ParseHeader(rec.Header().Get(HeaderKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Metrics) != 2 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+	for _, m := range h.Metrics {
+		if m.Duration < 10*time.Millisecond {
+			t.Fatalf("bad metric: %#v", m)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package servertiming
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// debugHandlerSize is the number of requests kept by DebugHandler.
+const debugHandlerSize = 100
+
+// DebugHandler returns an http.Handler that serves the metrics of recent
+// requests as JSON, along with the callback that records them. The
+// callback should be used as MiddlewareOpts.OnComplete:
+//
+//	debug, record := servertiming.DebugHandler()
+//	h = servertiming.Middleware(h, &servertiming.MiddlewareOpts{OnComplete: record})
+//	mux.Handle("/debug/timing", debug)
+//
+// The last 100 requests are kept, oldest first, in a RecentHeaders. The
+// metrics are copied so the handler never sees a *Header that is still
+// being modified.
+func DebugHandler() (http.Handler, func(*http.Request, *Header)) {
+	recent := NewRecentHeaders(debugHandlerSize)
+	return &debugHandler{recent: recent}, recent.add
+}
+
+// debugRequest is the JSON representation of a request in DebugHandler.
+type debugRequest struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Metrics []*Metric `json:"metrics"`
+}
+
+// debugHandler is the http.Handler returned by DebugHandler.
+type debugHandler struct {
+	recent *RecentHeaders
+}
+
+// ServeHTTP implements http.Handler.
+func (d *debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The recorded headers are never modified, so their metrics can be
+	// encoded without copying them again.
+	requests := d.recent.all()
+	result := make([]debugRequest, len(requests))
+	for i, req := range requests {
+		result[i] = debugRequest{
+			Time:    req.time,
+			Method:  req.method,
+			Path:    req.path,
+			Metrics: req.h.Metrics,
+		}
+		if result[i].Metrics == nil {
+			result[i].Metrics = []*Metric{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,40 @@
+package servertiming
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	debug, record := DebugHandler()
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("sql").WithDesc("MySQL").Duration = 10 * time.Millisecond
+		h.NewMetric("cache").WithExtra("hit", "true")
+		w.Write([]byte(responseBody))
+	}), &MiddlewareOpts{OnComplete: record})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	rec := httptest.NewRecorder()
+	debug.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/timing", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("bad content type: %q", ct)
+	}
+
+	var actual []debugRequest
+	if err := json.NewDecoder(rec.Body).Decode(&actual); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(actual) != 1 || actual[0].Method != "GET" || actual[0].Path != "/users" {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	expected := `sql;desc=MySQL;dur=10,cache;hit=true`
+	if s := (&Header{Metrics: actual[0].Metrics}).String(); s != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, s)
+	}
+}
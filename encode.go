@@ -0,0 +1,79 @@
+package servertiming
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EncodeOpts are options that control how metrics are encoded into a
+// Server-Timing header value. These only affect the encoded value: the
+// fields of the Metric, such as Duration, are never modified so that
+// anything else reading the metrics (logging, exporters, etc.) still sees
+// the exact recorded values.
+//
+// The zero value encodes metrics exactly as Metric.String does.
+type EncodeOpts struct {
+	// RoundTo rounds each duration to the nearest multiple of this value
+	// using time.Duration.Round before it is encoded. If this is zero or
+	// negative, durations are not rounded.
+	RoundTo time.Duration
+
+	// Digits is the maximum number of digits after the decimal point to
+	// use when encoding the duration in milliseconds. Trailing zeros are
+	// always removed. If this is zero or negative, as many digits as
+	// necessary are used to represent the duration exactly.
+	//
+	// RoundTo is applied first, so RoundTo of time.Millisecond results in
+	// whole milliseconds regardless of Digits, while Digits of 1 with no
+	// RoundTo turns 1.26ms into "1.3".
+	Digits int
+
+	// IntegerDurations truncates each duration to whole milliseconds so
+	// that "dur" is always an integer, such as "1" for 1.9ms. This is for
+	// compatibility with strict parsers that don't accept a fractional
+	// "dur". It is applied after RoundTo and makes Digits irrelevant.
+	IntegerDurations bool
+
+	// DurFirst encodes the "dur" param before the "desc" param. By default
+	// "desc" comes first. Both orders are valid, but some simple parsers
+	// depend on the position of the params.
+	DurFirst bool
+
+	// SortExtra encodes the extra params of each metric sorted by key.
+	// By default they're encoded in map iteration order, which is random.
+	SortExtra bool
+}
+
+// formatDuration formats the duration as a millisecond value for the
+// "dur" param according to the options. opts may be nil.
+func (opts *EncodeOpts) formatDuration(d time.Duration) string {
+	digits := -1
+	if opts != nil {
+		if opts.RoundTo > 0 {
+			d = d.Round(opts.RoundTo)
+		}
+
+		if opts.IntegerDurations {
+			d = d.Truncate(time.Millisecond)
+		}
+
+		if opts.Digits > 0 {
+			digits = opts.Digits
+		}
+	}
+
+	v := strconv.FormatFloat(durationMillis(d), 'f', digits, 64)
+	if digits > 0 {
+		// Trailing zeros are only possible with a fixed number of digits.
+		v = strings.TrimRight(strings.TrimRight(v, "0"), ".")
+	}
+
+	return v
+}
+
+// durationMillis returns d as fractional milliseconds, the unit of the
+// "dur" param.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,168 @@
+package servertiming
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeOpts_formatDuration(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     *EncodeOpts
+		Duration time.Duration
+		Expected string
+	}{
+		{
+			"nil opts",
+			nil,
+			1263 * time.Microsecond,
+			"1.263",
+		},
+
+		{
+			"zero opts",
+			&EncodeOpts{},
+			1263 * time.Microsecond,
+			"1.263",
+		},
+
+		{
+			"round to millisecond",
+			&EncodeOpts{RoundTo: time.Millisecond},
+			1263 * time.Microsecond,
+			"1",
+		},
+
+		{
+			"round to 100 microseconds",
+			&EncodeOpts{RoundTo: 100 * time.Microsecond},
+			1263 * time.Microsecond,
+			"1.3",
+		},
+
+		{
+			"digits",
+			&EncodeOpts{Digits: 1},
+			1263 * time.Microsecond,
+			"1.3",
+		},
+
+		{
+			"digits trims trailing zeros",
+			&EncodeOpts{Digits: 3},
+			1200 * time.Microsecond,
+			"1.2",
+		},
+
+		{
+			"digits trims whole number",
+			&EncodeOpts{Digits: 2},
+			100 * time.Millisecond,
+			"100",
+		},
+
+		{
+			"round is applied before digits",
+			&EncodeOpts{RoundTo: time.Millisecond, Digits: 2},
+			1263 * time.Microsecond,
+			"1",
+		},
+
+		{
+			"integer durations",
+			&EncodeOpts{IntegerDurations: true},
+			1963 * time.Microsecond,
+			"1",
+		},
+
+		{
+			"integer durations with digits",
+			&EncodeOpts{IntegerDurations: true, Digits: 2},
+			1963 * time.Microsecond,
+			"1",
+		},
+
+		{
+			"round is applied before integer durations",
+			&EncodeOpts{IntegerDurations: true, RoundTo: time.Millisecond},
+			1963 * time.Microsecond,
+			"2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			actual := tt.Opts.formatDuration(tt.Duration)
+			if actual != tt.Expected {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", actual, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestHeaderStringOpts(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "sql-1", Duration: 1263 * time.Microsecond},
+	}}
+
+	actual := h.StringOpts(&EncodeOpts{RoundTo: time.Millisecond})
+	if expected := "sql-1;dur=1"; actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+
+	// The recorded duration must remain exact
+	if h.Metrics[0].Duration != 1263*time.Microsecond {
+		t.Fatalf("duration was modified: %s", h.Metrics[0].Duration)
+	}
+}
+
+func TestMetricStringOpts_sortExtra(t *testing.T) {
+	m := &Metric{
+		Name:  "sql",
+		Extra: map[string]string{"c": "1", "flag": "", "a": "2", "b": "x y"},
+	}
+
+	expected := `sql;a=2;b="x y";c=1;flag`
+	for i := 0; i < 100; i++ {
+		actual := m.StringOpts(&EncodeOpts{SortExtra: true})
+		if actual != expected {
+			t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+		}
+	}
+}
+
+func TestMetricStringOpts_durFirst(t *testing.T) {
+	m := &Metric{Name: "sql", Desc: "MySQL", Duration: 10 * time.Millisecond}
+
+	cases := []struct {
+		Opts     *EncodeOpts
+		Expected string
+	}{
+		{nil, `sql;desc=MySQL;dur=10`},
+		{&EncodeOpts{DurFirst: true}, `sql;dur=10;desc=MySQL`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Expected, func(t *testing.T) {
+			actual := m.StringOpts(tt.Opts)
+			if actual != tt.Expected {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", actual, tt.Expected)
+			}
+
+			// Parsing is independent of the order
+			h, err := ParseHeader(actual)
+			if err != nil {
+				t.Fatalf("error parsing header: %s", err)
+			}
+			if p := h.Metrics[0]; p.Desc != m.Desc || p.Duration != m.Duration {
+				t.Fatalf("bad parsed metric: %#v", p)
+			}
+		})
+	}
+
+	// Only one of the params set
+	m = &Metric{Name: "sql", Desc: "MySQL"}
+	if actual := m.StringOpts(&EncodeOpts{DurFirst: true}); actual != `sql;desc=MySQL` {
+		t.Fatalf("bad: %q", actual)
+	}
+}
@@ -3,7 +3,8 @@ package servertiming
 import (
 	"fmt"
 	"net/http"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +26,10 @@ const HeaderKey = "Server-Timing"
 // Header pointer. This allows functions that use FromContext to get the
 // *Header value to skip nil-checking and use it as normal. On a nil
 // *Header, Metrics are not recorded.
+//
+// A Header doesn't need the Middleware or a context. The zero value is
+// ready to use, so a header value can be built anywhere with NewMetric or
+// Add followed by String or StringOpts.
 type Header struct {
 	// Metrics is the list of metrics in the header.
 	Metrics []*Metric
@@ -33,9 +38,51 @@ type Header struct {
 	// ONLY NEEDS TO BE SET WHEN working with Metrics directly. If using
 	// the functions on the struct, the lock is managed automatically.
 	sync.Mutex
+
+	// startTime is the start of the request this header is for, if known.
+	// This is set by the Middleware and used to compute start offsets and
+	// percentages.
+	startTime time.Time
+
+	// middleware is true if the header was created by a Middleware, which
+	// then writes it. Nested Middleware leave writing the header to it.
+	middleware bool
+
+	// owner is the state of the Middleware request that created this
+	// header. This is only set with MiddlewareOpts.DetectSharedHeader.
+	owner *middlewareState
+
+	// disabled is true if the header shouldn't be written for the request.
+	// See DisableForRequest.
+	disabled bool
+
+	// sequence is true if the metrics added with the functions on the
+	// struct are numbered. See MiddlewareOpts.Sequence.
+	sequence bool
+
+	// seq is the sequence number of the last metric added with the
+	// functions on the struct, if sequence is set.
+	seq int
+
+	// budget is the maximum number of metrics recorded by the functions
+	// on the struct, if positive. See MiddlewareOpts.Budget.
+	budget int
+
+	// pending counts the goroutines started with Go whose metric isn't
+	// stopped yet.
+	pending sync.WaitGroup
+
+	// cold is true if the request this header is for was the first on
+	// its connection. See MiddlewareOpts.CaptureCold.
+	cold bool
 }
 
 // ParseHeader parses a Server-Timing header value.
+//
+// The "dur" param is parsed as milliseconds as specified. For
+// compatibility with non-compliant senders, a value with a unit suffix
+// understood by time.ParseDuration, such as "5ms" or "5000us", is also
+// accepted. Durations are always encoded as bare milliseconds.
 func ParseHeader(input string) (*Header, error) {
 	// Split the comma-separated list of metrics
 	rawMetrics := header.ParseList(headerParams(input))
@@ -46,7 +93,18 @@ func ParseHeader(input string) (*Header, error) {
 	metrics := make([]*Metric, 0, len(rawMetrics))
 	for _, raw := range rawMetrics {
 		var m Metric
-		m.Name, m.Extra = header.ParseValueAndParams(headerParams(raw))
+		m.Name, m.Extra = parseMetric(raw)
+
+		// An entry without a valid name, such as a stray separator, is
+		// malformed and skipped.
+		if m.Name == "" {
+			continue
+		}
+
+		// Param names are case-insensitive. parseMetric lowercases the
+		// keys it returns, so the lookups below match "desc", "Desc",
+		// "DESC", etc. and String always emits the canonical lowercase
+		// names.
 
 		// Description
 		if v, ok := m.Extra[paramNameDesc]; ok {
@@ -58,8 +116,23 @@ func ParseHeader(input string) (*Header, error) {
 		// is what modern browsers are treating it as. If the parsing of
 		// an integer fails, the set value remains in the Extra field.
 		if v, ok := m.Extra[paramNameDur]; ok {
-			m.Duration, _ = time.ParseDuration(v + "ms")
+			var err error
+			m.Duration, err = parseDuration(v)
 			delete(m.Extra, paramNameDur)
+
+			// A non-zero duration is always measured, so this only needs
+			// to be recorded to keep an explicit "dur=0".
+			if err == nil && m.Duration == 0 {
+				m.measured = true
+			}
+		}
+
+		// Count. If this isn't a valid integer then it is left in Extra.
+		if v, ok := m.Extra[paramNameCount]; ok {
+			if n, err := strconv.Atoi(v); err == nil {
+				m.Count = n
+				delete(m.Extra, paramNameCount)
+			}
 		}
 
 		metrics = append(metrics, &m)
@@ -73,7 +146,23 @@ func (h *Header) NewMetric(name string) *Metric {
 	return h.Add(&Metric{Name: name})
 }
 
-// Add adds the given metric to the header.
+// AddDuration creates a new Metric with an already known duration and
+// adds it to this header. See NewMetricFromDuration.
+//
+// This function is safe to call concurrently.
+func (h *Header) AddDuration(name string, d time.Duration) *Metric {
+	return h.Add(NewMetricFromDuration(name, d))
+}
+
+// Add adds the given metric to the header and returns it. This allows
+// building a metric, adding it and keeping it to annotate later in a
+// single line:
+//
+//	m := h.Add(&Metric{Name: "sql"}).WithDesc("MySQL")
+//
+// If the header was created by a Middleware with a Budget that is used
+// up, the metric is returned but not recorded, the same as on a nil
+// *Header.
 //
 // This function is safe to call concurrently.
 func (h *Header) Add(m *Metric) *Metric {
@@ -83,27 +172,474 @@ func (h *Header) Add(m *Metric) *Metric {
 
 	h.Lock()
 	defer h.Unlock()
+	return h.add(m)
+}
+
+// add is the implementation of Add. The lock must be held.
+func (h *Header) add(m *Metric) *Metric {
+	if h.budget > 0 && len(h.Metrics) >= h.budget {
+		return m
+	}
+
+	if h.sequence {
+		h.seq++
+		m.seq = h.seq
+	}
+
 	h.Metrics = append(h.Metrics, m)
 	return m
 }
 
+// CacheHit records a cache hit on the metric with the given name, creating
+// it if necessary. The description of the metric summarizes the hits and
+// misses recorded with CacheHit and CacheMiss, such as "3 hits, 1 miss".
+// This results in a single readable entry for all of the cache lookups of
+// a request. The metric can still be timed as usual, such as with Observe.
+//
+// This function is safe to call concurrently.
+func (h *Header) CacheHit(name string) *Metric {
+	return h.cacheLookup(name, true)
+}
+
+// CacheMiss records a cache miss on the metric with the given name. See
+// CacheHit.
+//
+// This function is safe to call concurrently.
+func (h *Header) CacheMiss(name string) *Metric {
+	return h.cacheLookup(name, false)
+}
+
+// cacheLookup records a cache hit or miss for CacheHit and CacheMiss.
+func (h *Header) cacheLookup(name string, hit bool) *Metric {
+	if h == nil {
+		return &Metric{Name: name}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	var m *Metric
+	for _, existing := range h.Metrics {
+		if existing.Name == name {
+			m = existing
+			break
+		}
+	}
+	if m == nil {
+		m = h.add(&Metric{Name: name})
+	}
+
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+
+	m.Desc = fmt.Sprintf("%s, %s",
+		plural(m.cacheHits, "hit", "hits"),
+		plural(m.cacheMisses, "miss", "misses"))
+	return m
+}
+
+// plural returns n followed by the singular or plural form of a word.
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return "1 " + singular
+	}
+
+	return strconv.Itoa(n) + " " + plural
+}
+
+// AppendFromString parses the raw Server-Timing header value s with
+// ParseHeader and adds all of its metrics to this header. This is useful
+// to merge the timings reported by a downstream service into the current
+// header. Malformed input is handled the same way as ParseHeader.
+//
+// This function is safe to call concurrently.
+func (h *Header) AppendFromString(s string) error {
+	parsed, err := ParseHeader(s)
+	if err != nil {
+		return err
+	}
+
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for _, m := range parsed.Metrics {
+		h.add(m)
+	}
+
+	return nil
+}
+
+// Drain removes all of the metrics from the header and returns them. This
+// allows metrics to be handled in batches, such as sending some early and
+// recording more afterwards, without losing metrics added concurrently.
+//
+// The Middleware only writes the metrics in the header at the time the
+// response header is written, so any metrics drained before that are not
+// sent unless they are added back.
+//
+// This function is safe to call concurrently.
+func (h *Header) Drain() []*Metric {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	metrics := h.Metrics
+	h.Metrics = nil
+	return metrics
+}
+
+// Clone returns a copy of the header. The metrics are copied as well so
+// that modifying the returned header or its metrics does not affect h.
+//
+// This function is safe to call concurrently.
+func (h *Header) Clone() *Header {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	return h.clone()
+}
+
+// clone is the implementation of Clone. The lock must be held.
+func (h *Header) clone() *Header {
+	metrics := make([]*Metric, len(h.Metrics))
+	for i, m := range h.Metrics {
+		metrics[i] = m.clone()
+	}
+
+	return &Header{Metrics: metrics, startTime: h.startTime, seq: h.seq}
+}
+
+// Dedup collapses metrics that share the same name into a single metric.
+// The durations and counts of the collapsed metrics are summed and the
+// description and extra params of the first metric with that name are
+// kept. The order of the first occurrence of each name is preserved.
+//
+// This function is safe to call concurrently.
+func (h *Header) Dedup() {
+	h.DedupMerge(nil)
+}
+
+// DedupMerge is like Dedup but combines the extra params of the collapsed
+// metrics with merge instead of dropping them. For each metric that is
+// collapsed into an earlier one with the same name, merge is called with
+// the Extra field of the earlier metric as dst, allocated if necessary,
+// and the Extra field of the collapsed metric as src. merge modifies dst,
+// such as by summing a numeric param. If merge is nil, this is the same
+// as Dedup.
+//
+// This function is safe to call concurrently.
+func (h *Header) DedupMerge(merge func(dst, src map[string]string)) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	metrics := make([]*Metric, 0, len(h.Metrics))
+	seen := make(map[string]*Metric, len(h.Metrics))
+	for _, m := range h.Metrics {
+		existing, ok := seen[m.Name]
+		if !ok {
+			seen[m.Name] = m
+			metrics = append(metrics, m)
+			continue
+		}
+
+		existing.Count = observations(existing) + observations(m)
+		existing.Duration += m.Duration
+		if merge != nil {
+			if existing.Extra == nil {
+				existing.Extra = make(map[string]string, len(m.Extra))
+			}
+			merge(existing.Extra, m.Extra)
+		}
+	}
+
+	h.Metrics = metrics
+}
+
+// ReduceMode is how Header.Reduce combines the durations of metrics.
+type ReduceMode int
+
+const (
+	// ReduceSum sums the durations, the same as Dedup.
+	ReduceSum ReduceMode = iota
+
+	// ReduceMax uses the longest duration. For concurrent operations this
+	// is the wall-clock time spent waiting on the slowest one.
+	ReduceMax
+
+	// ReduceMin uses the shortest duration.
+	ReduceMin
+
+	// ReduceAvg uses the average duration of a single observation.
+	ReduceAvg
+)
+
+// Reduce collapses all metrics with the given name into a single metric
+// at the position of the first one. The duration is combined according
+// to mode and Count is set to the total number of observations. The
+// description and extra params of the first metric are kept.
+//
+// This is useful when summing the durations overcounts the time taken,
+// such as for several concurrent calls to the same service.
+//
+// This function is safe to call concurrently.
+func (h *Header) Reduce(name string, mode ReduceMode) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	var first *Metric
+	var total time.Duration
+	var count int
+	metrics := make([]*Metric, 0, len(h.Metrics))
+	for _, m := range h.Metrics {
+		if m.Name != name {
+			metrics = append(metrics, m)
+			continue
+		}
+
+		total += m.Duration
+		count += observations(m)
+		if first == nil {
+			first = m
+			metrics = append(metrics, m)
+			continue
+		}
+
+		switch mode {
+		case ReduceMax:
+			if m.Duration > first.Duration {
+				first.Duration = m.Duration
+			}
+		case ReduceMin:
+			if m.Duration < first.Duration {
+				first.Duration = m.Duration
+			}
+		}
+	}
+
+	if first == nil {
+		return
+	}
+
+	switch mode {
+	case ReduceSum:
+		first.Duration = total
+	case ReduceAvg:
+		first.Duration = total / time.Duration(count)
+	}
+
+	if count > 1 {
+		first.Count = count
+	}
+
+	h.Metrics = metrics
+}
+
+// WallClock returns the wall-clock time covered by the metrics with the
+// given names, or by all metrics if no names are given. Overlapping time
+// is only counted once, so five concurrent 50ms operations result in
+// 50ms rather than the 250ms their durations sum to.
+//
+// Only metrics that were timed with Start and Stop (or StartAt, StopAt,
+// WithInterval) have a known interval. Other metrics, such as those
+// created with AddDuration, are ignored.
+//
+// This function is safe to call concurrently.
+func (h *Header) WallClock(names ...string) time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	type interval struct{ start, stop time.Time }
+	intervals := make([]interval, 0, len(h.Metrics))
+	for _, m := range h.Metrics {
+		if m.startTime.IsZero() || m.stopTime.IsZero() {
+			continue
+		}
+		if len(names) > 0 && !containsString(names, m.Name) {
+			continue
+		}
+
+		intervals = append(intervals, interval{m.startTime, m.stopTime})
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+
+	// Sum the intervals, skipping the part of each that overlaps with
+	// the intervals before it.
+	var total time.Duration
+	var end time.Time
+	for _, i := range intervals {
+		if i.start.Before(end) {
+			i.start = end
+		}
+		if i.stop.After(i.start) {
+			total += i.stop.Sub(i.start)
+			end = i.stop
+		}
+	}
+
+	return total
+}
+
+// Sort sorts the metrics using less. The sort is stable so metrics that
+// are equal according to less keep the order they were recorded in.
+//
+// This function is safe to call concurrently.
+func (h *Header) Sort(less func(a, b *Metric) bool) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	sort.SliceStable(h.Metrics, func(i, j int) bool {
+		return less(h.Metrics[i], h.Metrics[j])
+	})
+}
+
+// SortByDuration sorts the metrics by duration, longest first. Metrics
+// with equal durations keep the order they were recorded in.
+//
+// This function is safe to call concurrently.
+func (h *Header) SortByDuration() {
+	h.Sort(func(a, b *Metric) bool {
+		return a.Duration > b.Duration
+	})
+}
+
+// Validate checks every metric with Metric.Validate. If any metrics are
+// invalid, the returned error includes the error for each of them.
+//
+// This function is safe to call concurrently.
+func (h *Header) Validate() error {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	return h.validate()
+}
+
+// validate is the implementation of Validate. The lock must be held.
+func (h *Header) validate() error {
+	var errs []string
+	for _, m := range h.Metrics {
+		if err := m.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d invalid metric(s): %s", len(errs), strings.Join(errs, "; "))
+}
+
 // String returns the valid Server-Timing header value that can be
 // sent in an HTTP response.
 func (h *Header) String() string {
+	return h.StringOpts(nil)
+}
+
+// StringOpts returns the valid Server-Timing header value encoded
+// according to opts. opts may be nil to use the defaults.
+func (h *Header) StringOpts(opts *EncodeOpts) string {
 	parts := make([]string, 0, len(h.Metrics))
 	for _, m := range h.Metrics {
-		parts = append(parts, m.String())
+		parts = append(parts, m.StringOpts(opts))
 	}
 
 	return strings.Join(parts, ",")
 }
 
+// Encode is like String but also validates the metrics with Validate.
+// The header value is returned even if some metrics are invalid, but
+// clients may then drop the entire header, so callers that care about
+// the metrics arriving should handle the error.
+//
+// This function is safe to call concurrently.
+func (h *Header) Encode() (string, error) {
+	if h == nil {
+		return "", nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	return h.StringOpts(nil), h.validate()
+}
+
+// Size returns the length in bytes of the header value that String
+// returns, without building it. This is useful to check the header against
+// a size limit.
+func (h *Header) Size() int {
+	return h.sizeOpts(nil)
+}
+
+// sizeOpts returns the length in bytes of the header value that
+// StringOpts returns for opts.
+func (h *Header) sizeOpts(opts *EncodeOpts) int {
+	if h == nil || len(h.Metrics) == 0 {
+		return 0
+	}
+
+	// One comma between each metric
+	n := len(h.Metrics) - 1
+	for _, m := range h.Metrics {
+		n += m.sizeOpts(opts)
+	}
+
+	return n
+}
+
 // Specified server-timing-param-name values.
 const (
 	paramNameDesc = "desc"
 	paramNameDur  = "dur"
 )
 
+// Non-standard server-timing-param-name values that this package
+// understands.
+const (
+	paramNameCount  = "count"
+	paramNameError  = "error"
+	paramNameStart  = "start"
+	paramNameSeq    = "seq"
+	paramNamePct    = "pct"
+	paramNameClass  = "class"
+	paramNameMethod = "method"
+	paramNameRoute  = "route"
+	paramNameCold   = "cold"
+	paramNameNum    = "num"
+	paramNameBytes  = "bytes"
+)
+
 // headerParams is a helper function that takes a header value and turns
 // it into the expected argument format for the httputil/header library
 // functions..
@@ -114,16 +650,46 @@ func headerParams(s string) (http.Header, string) {
 	}), key
 }
 
-var reNumber = regexp.MustCompile(`^\d+\.?\d*$`)
-
 // headerEncodeParam encodes a key/value pair as a proper `key=value`
-// syntax, using double-quotes if necessary.
+// syntax, using double-quotes if the value is not a valid token.
 func headerEncodeParam(key, value string) string {
-	// The only case we currently don't quote is numbers. We can make this
-	// smarter in the future.
-	if reNumber.MatchString(value) {
-		return fmt.Sprintf(`%s=%s`, key, value)
+	if isToken(value) {
+		return key + "=" + value
+	}
+
+	return key + "=" + quoteString(value)
+}
+
+// headerEncodeParamSize returns the length of headerEncodeParam(key, value).
+func headerEncodeParamSize(key, value string) int {
+	if isToken(value) {
+		return len(key) + 1 + len(value)
 	}
 
-	return fmt.Sprintf(`%s=%q`, key, value)
+	// Surrounding quotes plus one backslash per escaped byte
+	n := len(key) + 3 + len(value)
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == '"' || c == '\\' {
+			n++
+		}
+	}
+
+	return n
+}
+
+// quoteString encodes s as an RFC7230 "quoted-string". Only double-quotes
+// and backslashes need to be escaped. Go's %q is not used since its escape
+// sequences such as "\t" and "\u00e9" are not understood by clients.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
 }
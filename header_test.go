@@ -1,7 +1,13 @@
 package servertiming
 
 import (
+	"encoding/json"
+	"math"
+	"math/rand"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -51,6 +57,32 @@ var headerCases = []struct {
 		`sql-1;desc="MySQL; lookup Server";dur=100`,
 	},
 
+	// Description that is a valid token is sent without quotes
+	{
+		[]*Metric{
+			{
+				Name:     "sql-1",
+				Duration: 100 * time.Millisecond,
+				Desc:     "MySQL",
+				Extra:    map[string]string{},
+			},
+		},
+		`sql-1;desc=MySQL;dur=100`,
+	},
+
+	// Quotes in description
+	{
+		[]*Metric{
+			{
+				Name:     "sql-1",
+				Duration: 100 * time.Millisecond,
+				Desc:     `"primary"`,
+				Extra:    map[string]string{},
+			},
+		},
+		`sql-1;desc="\"primary\"";dur=100`,
+	},
+
 	// Description that contains a number
 	{
 		[]*Metric{
@@ -76,6 +108,55 @@ var headerCases = []struct {
 		},
 		`sql-1;desc="MySQL; lookup Server";dur=100.1`,
 	},
+
+	// Aggregated metric with a count
+	{
+		[]*Metric{
+			{
+				Name:     "sql-1",
+				Duration: 120 * time.Millisecond,
+				Count:    5,
+				Extra:    map[string]string{},
+			},
+		},
+		`sql-1;dur=120;count=5`,
+	},
+
+	// Param without a value
+	{
+		[]*Metric{
+			{
+				Name:     "sql-1",
+				Duration: 5 * time.Millisecond,
+				Extra:    map[string]string{"cached": ""},
+			},
+		},
+		`sql-1;dur=5;cached`,
+	},
+}
+
+func TestHeaderEncodeParam(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected string
+	}{
+		{"fast", `desc=fast`},
+		{"10.5", `desc=10.5`},
+		{"", `desc=""`},
+		{"very fast", `desc="very fast"`},
+		{"a,b", `desc="a,b"`},
+		{"a;b", `desc="a;b"`},
+		{"a=b", `desc="a=b"`},
+		{`a\b`, `desc="a\\b"`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Value, func(t *testing.T) {
+			if actual := headerEncodeParam(paramNameDesc, tt.Value); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
 }
 
 func TestParseHeader(t *testing.T) {
@@ -121,3 +202,756 @@ func TestHeaderAdd(t *testing.T) {
 		})
 	}
 }
+
+func TestHeaderAdd_chain(t *testing.T) {
+	var h Header
+	m := h.Add(&Metric{Name: "sql"}).WithDesc("MySQL")
+
+	// Annotating the returned metric later changes the recorded metric
+	m.WithExtra("rows", "10")
+	if len(h.Metrics) != 1 || h.Metrics[0] != m {
+		t.Fatalf("should record the returned metric: %#v", h.Metrics)
+	}
+	if actual := h.String(); actual != "sql;desc=MySQL;rows=10" {
+		t.Fatalf("bad: %q", actual)
+	}
+
+	var nilHeader *Header
+	if m := nilHeader.Add(&Metric{Name: "sql"}); m == nil || m.Name != "sql" {
+		t.Fatalf("should return the metric on a nil header: %#v", m)
+	}
+}
+
+// Same as TestHeaderString but round-tripping the metrics through JSON
+// first. Durations must survive exactly and descriptions with special
+// characters must be escaped.
+func TestHeaderJSON(t *testing.T) {
+	for _, tt := range headerCases {
+		t.Run(tt.HeaderValue, func(t *testing.T) {
+			data, err := json.Marshal(&Header{Metrics: tt.Metrics})
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			var h Header
+			if err := json.Unmarshal(data, &h); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			if len(h.Metrics) != len(tt.Metrics) {
+				t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, tt.Metrics)
+			}
+			for i, m := range h.Metrics {
+				expected := tt.Metrics[i]
+				if m.Name != expected.Name ||
+					m.Desc != expected.Desc ||
+					m.Duration != expected.Duration ||
+					m.Count != expected.Count ||
+					len(m.Extra) != len(expected.Extra) {
+					t.Fatalf("received, expected:\n\n%#v\n\n%#v", m, expected)
+				}
+				for k, v := range expected.Extra {
+					if actual, ok := m.Extra[k]; !ok || actual != v {
+						t.Fatalf("bad extra %q: %#v", k, m.Extra)
+					}
+				}
+			}
+
+			if actual := h.String(); actual != tt.HeaderValue {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", actual, tt.HeaderValue)
+			}
+		})
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	for _, tt := range headerCases {
+		t.Run(tt.HeaderValue, func(t *testing.T) {
+			h := &Header{Metrics: tt.Metrics}
+			if actual := h.Size(); actual != len(tt.HeaderValue) {
+				t.Fatalf("received, expected:\n\n%d\n\n%d", actual, len(tt.HeaderValue))
+			}
+		})
+	}
+
+	t.Run("multiple metrics with opts", func(t *testing.T) {
+		h := &Header{}
+		h.NewMetric("sql").WithDesc("a \"b\"").Observe(1263 * time.Microsecond).Observe(time.Millisecond)
+		h.NewMetric("cache").WithExtra("hit", "").WithExtra("region", "us east")
+		h.AddDuration("zero", 0)
+
+		for _, opts := range []*EncodeOpts{nil, {Digits: 1}, {IntegerDurations: true, DurFirst: true}} {
+			if actual, expected := h.sizeOpts(opts), len(h.StringOpts(opts)); actual != expected {
+				t.Fatalf("%#v: received, expected:\n\n%d\n\n%d", opts, actual, expected)
+			}
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var h *Header
+		if h.Size() != 0 || (&Header{}).Size() != 0 {
+			t.Fatal("should be zero")
+		}
+	})
+}
+
+func TestParseHeader_caseInsensitiveParams(t *testing.T) {
+	cases := []struct {
+		HeaderValue string
+		Metric      *Metric
+		String      string
+	}{
+		{
+			`sql-1;Desc="MySQL";Dur=100`,
+			&Metric{
+				Name:     "sql-1",
+				Duration: 100 * time.Millisecond,
+				Desc:     "MySQL",
+				Extra:    map[string]string{},
+			},
+			`sql-1;desc=MySQL;dur=100`,
+		},
+
+		{
+			`sql-1;DESC="MySQL";DUR=100`,
+			&Metric{
+				Name:     "sql-1",
+				Duration: 100 * time.Millisecond,
+				Desc:     "MySQL",
+				Extra:    map[string]string{},
+			},
+			`sql-1;desc=MySQL;dur=100`,
+		},
+
+		{
+			`sql-1;dEsC="MySQL";dUr=100.1`,
+			&Metric{
+				Name:     "sql-1",
+				Duration: 100100 * time.Microsecond,
+				Desc:     "MySQL",
+				Extra:    map[string]string{},
+			},
+			`sql-1;desc=MySQL;dur=100.1`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.HeaderValue, func(t *testing.T) {
+			h, err := ParseHeader(tt.HeaderValue)
+			if err != nil {
+				t.Fatalf("error parsing header: %s", err)
+			}
+
+			expected := []*Metric{tt.Metric}
+			if !reflect.DeepEqual(h.Metrics, expected) {
+				t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+			}
+
+			// String always emits the canonical lowercase param names
+			actual := h.String()
+			if actual != tt.String {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", actual, tt.String)
+			}
+		})
+	}
+}
+
+func TestHeaderClone(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "a", Duration: time.Millisecond, Extra: map[string]string{"k": "v"}},
+	}}
+
+	c := h.Clone()
+	if !reflect.DeepEqual(h.Metrics, c.Metrics) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", c.Metrics, h.Metrics)
+	}
+
+	c.Metrics[0].Name = "b"
+	c.Metrics[0].Extra["k"] = "changed"
+	if h.Metrics[0].Name != "a" || h.Metrics[0].Extra["k"] != "v" {
+		t.Fatalf("original was modified: %#v", h.Metrics[0])
+	}
+}
+
+// TestHeader_standalone builds a header without the Middleware or a
+// context, as a CLI or non-HTTP RPC would.
+func TestHeader_standalone(t *testing.T) {
+	var h Header
+	h.NewMetric("sql").WithDesc("SQL query").Duration = 20400 * time.Microsecond
+	h.AddDuration("cache", 5*time.Millisecond)
+	h.Add(NewMetricFromDuration("render", 0)).WithExtra("cached", "")
+	if err := h.AppendFromString("db;dur=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `sql;desc="SQL query";dur=20.4,cache;dur=5,render;dur=0;cached,db;dur=1`
+	if actual := h.String(); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if actual := h.Size(); actual != len(expected) {
+		t.Fatalf("bad size: %d", actual)
+	}
+
+	expected = `sql;desc="SQL query";dur=20,cache;dur=5,render;dur=0;cached,db;dur=1`
+	if actual := h.StringOpts(&EncodeOpts{IntegerDurations: true}); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+// TestHeader_concurrent records metrics on a shared *Header from many
+// goroutines, the same as the example does. This is mostly useful with
+// the race detector enabled. The header is only encoded once all the
+// goroutines are done, since a Metric itself isn't safe to read while
+// it is being stopped.
+func TestHeader_concurrent(t *testing.T) {
+	const goroutines, perGoroutine = 100, 10
+
+	var h Header
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				name := "worker-" + strconv.Itoa(i)
+				if j%2 == 0 {
+					h.NewMetric(name).WithDesc("timed").Start().Stop()
+				} else {
+					h.AddDuration(name, time.Duration(j)*time.Millisecond)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	parsed, err := ParseHeader(h.String())
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+	if len(parsed.Metrics) != goroutines*perGoroutine {
+		t.Fatalf("expected %d metrics, got %d", goroutines*perGoroutine, len(parsed.Metrics))
+	}
+
+	counts := make(map[string]int)
+	for _, m := range parsed.Metrics {
+		counts[m.Name]++
+	}
+	for i := 0; i < goroutines; i++ {
+		if n := counts["worker-"+strconv.Itoa(i)]; n != perGoroutine {
+			t.Fatalf("expected %d metrics for worker %d, got %d", perGoroutine, i, n)
+		}
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	var h Header
+	h.NewMetric("sql")
+	h.CacheMiss("cache").Observe(5 * time.Millisecond)
+	h.CacheHit("cache")
+	h.CacheHit("cache").Observe(time.Millisecond)
+	h.CacheHit("cdn")
+
+	expected := `sql,cache;desc="2 hits, 1 miss";dur=6;count=2,cdn;desc="1 hit, 0 misses"`
+	if actual := h.String(); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestHeaderCache_nil(t *testing.T) {
+	var h *Header
+	if m := h.CacheHit("cache"); m == nil || m.Name != "cache" {
+		t.Fatalf("bad: %#v", m)
+	}
+}
+
+func TestHeaderDrain(t *testing.T) {
+	var h Header
+	a := h.NewMetric("a")
+	b := h.NewMetric("b")
+
+	drained := h.Drain()
+	if len(drained) != 2 || drained[0] != a || drained[1] != b {
+		t.Fatalf("bad: %#v", drained)
+	}
+	if len(h.Metrics) != 0 {
+		t.Fatalf("should be empty: %#v", h.Metrics)
+	}
+
+	// Recording continues after draining
+	c := h.NewMetric("c")
+	if drained := h.Drain(); len(drained) != 1 || drained[0] != c {
+		t.Fatalf("bad: %#v", drained)
+	}
+}
+
+func TestHeaderDrain_nil(t *testing.T) {
+	var h *Header
+	if h.Drain() != nil {
+		t.Fatal("should be nil")
+	}
+}
+
+func TestHeaderDedup(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "sql", Duration: 10 * time.Millisecond, Desc: "first"},
+		{Name: "cache", Duration: 1 * time.Millisecond},
+		{Name: "sql", Duration: 20 * time.Millisecond, Desc: "second"},
+		{Name: "sql", Duration: 30 * time.Millisecond, Count: 2},
+	}}
+	h.Dedup()
+
+	expected := []*Metric{
+		{Name: "sql", Duration: 60 * time.Millisecond, Desc: "first", Count: 4},
+		{Name: "cache", Duration: 1 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+}
+
+func TestHeaderDedupMerge(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "cache", Extra: map[string]string{"hits": "1", "region": "us"}},
+		{Name: "sql", Duration: 10 * time.Millisecond},
+		{Name: "cache", Extra: map[string]string{"hits": "2", "stale": ""}},
+		{Name: "cache"},
+		{Name: "sql", Extra: map[string]string{"hits": "3"}},
+	}}
+
+	// Sum the hits and keep any other params that are set.
+	h.DedupMerge(func(dst, src map[string]string) {
+		for k, v := range src {
+			if k == "hits" {
+				a, _ := strconv.Atoi(dst[k])
+				b, _ := strconv.Atoi(v)
+				v = strconv.Itoa(a + b)
+			}
+
+			dst[k] = v
+		}
+	})
+
+	expected := []*Metric{
+		{Name: "cache", Count: 3, Extra: map[string]string{"hits": "3", "region": "us", "stale": ""}},
+		{Name: "sql", Duration: 10 * time.Millisecond, Count: 2, Extra: map[string]string{"hits": "3"}},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+}
+
+func TestHeaderDedup_nil(t *testing.T) {
+	var h *Header
+	h.Dedup()
+}
+
+func TestHeaderReduce(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Mode     ReduceMode
+		Duration time.Duration
+	}{
+		{"sum", ReduceSum, 60 * time.Millisecond},
+		{"max", ReduceMax, 30 * time.Millisecond},
+		{"min", ReduceMin, 10 * time.Millisecond},
+		{"avg", ReduceAvg, 15 * time.Millisecond},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			h := &Header{Metrics: []*Metric{
+				{Name: "cache", Duration: 1 * time.Millisecond},
+				{Name: "svc", Duration: 20 * time.Millisecond, Desc: "first"},
+				{Name: "other", Duration: 2 * time.Millisecond},
+				{Name: "svc", Duration: 10 * time.Millisecond, Desc: "second"},
+				{Name: "svc", Duration: 30 * time.Millisecond, Count: 2},
+			}}
+			h.Reduce("svc", tt.Mode)
+
+			expected := []*Metric{
+				{Name: "cache", Duration: 1 * time.Millisecond},
+				{Name: "svc", Duration: tt.Duration, Desc: "first", Count: 4},
+				{Name: "other", Duration: 2 * time.Millisecond},
+			}
+			if !reflect.DeepEqual(h.Metrics, expected) {
+				t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+			}
+		})
+	}
+}
+
+func TestHeaderReduce_single(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "svc", Duration: 20 * time.Millisecond},
+	}}
+	h.Reduce("svc", ReduceAvg)
+	h.Reduce("missing", ReduceAvg)
+
+	expected := []*Metric{
+		{Name: "svc", Duration: 20 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+}
+
+func TestHeaderReduce_nil(t *testing.T) {
+	var h *Header
+	h.Reduce("svc", ReduceSum)
+}
+
+func TestHeaderWallClock(t *testing.T) {
+	base := time.Now()
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	var h Header
+	h.NewMetric("svc").WithInterval(at(0), at(50))
+	h.NewMetric("svc").WithInterval(at(10), at(40))
+	h.NewMetric("svc").WithInterval(at(30), at(60))
+	h.NewMetric("svc").WithInterval(at(100), at(110))
+	h.NewMetric("db").WithInterval(at(55), at(80))
+	h.NewMetric("running").Start()
+	h.AddDuration("svc", time.Second)
+
+	cases := []struct {
+		Name     string
+		Names    []string
+		Expected time.Duration
+	}{
+		{"one name", []string{"svc"}, 70 * time.Millisecond},
+		{"multiple names", []string{"svc", "db"}, 90 * time.Millisecond},
+		{"all", nil, 90 * time.Millisecond},
+		{"missing", []string{"missing"}, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			if actual := h.WallClock(tt.Names...); actual != tt.Expected {
+				t.Fatalf("received, expected:\n\n%s\n\n%s", actual, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestHeaderWallClock_nil(t *testing.T) {
+	var h *Header
+	if h.WallClock() != 0 {
+		t.Fatal("should be zero")
+	}
+}
+
+// Parsing must never merge metrics. Merging is left to Dedup and Reduce so
+// clients see every entry that was sent.
+func TestParseHeader_duplicateNames(t *testing.T) {
+	h, err := ParseHeader(`a;dur=1, a;dur=2;desc=second, b, a`)
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+
+	expected := []*Metric{
+		{Name: "a", Duration: 1 * time.Millisecond, Extra: map[string]string{}},
+		{Name: "a", Duration: 2 * time.Millisecond, Desc: "second", Extra: map[string]string{}},
+		{Name: "b", Extra: map[string]string{}},
+		{Name: "a", Extra: map[string]string{}},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+}
+
+func TestParseHeader_flagParam(t *testing.T) {
+	h, err := ParseHeader(`sql-1;cached;dur=5`)
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+
+	expected := []*Metric{
+		{
+			Name:     "sql-1",
+			Duration: 5 * time.Millisecond,
+			Extra:    map[string]string{"cached": ""},
+		},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+
+	// Round-trip the encoded value
+	h2, err := ParseHeader(h.String())
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+	if !reflect.DeepEqual(h2.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h2.Metrics, expected)
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "valid"},
+		{Name: "bad name"},
+		{Name: "bad-desc", Desc: "\n"},
+	}}
+
+	err := h.Validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, name := range []string{"bad name", "bad-desc"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("expected error to name %q: %s", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"valid"`) {
+		t.Fatalf("error should not name valid metric: %s", err)
+	}
+
+	h.Metrics = h.Metrics[:1]
+	if err := h.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestHeaderEncode(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "sql", Duration: 10 * time.Millisecond},
+		{Name: "bad name"},
+	}}
+
+	actual, err := h.Encode()
+	if err == nil || !strings.Contains(err.Error(), "bad name") {
+		t.Fatalf("expected error naming the invalid metric: %v", err)
+	}
+	if actual != h.String() {
+		t.Fatalf("should return the header value anyway: %q", actual)
+	}
+
+	h.Metrics = h.Metrics[:1]
+	actual, err = h.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if actual != "sql;dur=10" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestHeaderEncode_nil(t *testing.T) {
+	var h *Header
+	if actual, err := h.Encode(); actual != "" || err != nil {
+		t.Fatalf("bad: %q %v", actual, err)
+	}
+}
+
+func TestParseHeader_durationUnits(t *testing.T) {
+	h, err := ParseHeader(`a;dur=5ms,b;dur=5000us,c;dur=5`)
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+
+	for _, m := range h.Metrics {
+		if m.Duration != 5*time.Millisecond {
+			t.Fatalf("bad duration for %q: %s", m.Name, m.Duration)
+		}
+	}
+
+	// Encoding always uses bare milliseconds
+	expected := "a;dur=5,b;dur=5,c;dur=5"
+	if actual := h.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+}
+
+// TestHeader_roundTrip generates random metrics and verifies that parsing
+// the encoded value of each results in the same metric. This keeps the
+// encoder and the parser from drifting apart.
+func TestHeader_roundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+
+	const tokenChars = "abcdefghijklmnopqrstuvwxyz0123456789!#$%&'*+-.^_`|~"
+	randToken := func() string {
+		b := make([]byte, 1+rnd.Intn(8))
+		for i := range b {
+			b[i] = tokenChars[rnd.Intn(len(tokenChars))]
+		}
+		return string(b)
+	}
+
+	// Values may contain anything that can be quoted: printable ASCII
+	// including separators, quotes and backslashes, tabs and UTF-8.
+	const valueChars = " \t\"\\,;=abcXYZ019!~"
+	randValue := func() string {
+		var b strings.Builder
+		for n := rnd.Intn(12); n > 0; n-- {
+			if rnd.Intn(10) == 0 {
+				b.WriteString("é")
+				continue
+			}
+			b.WriteByte(valueChars[rnd.Intn(len(valueChars))])
+		}
+		return b.String()
+	}
+
+	for i := 0; i < 1000; i++ {
+		m := &Metric{
+			Name:     randToken(),
+			Duration: time.Duration(rnd.Int63n(int64(10 * time.Minute))),
+			Desc:     randValue(),
+			Extra:    map[string]string{},
+		}
+		for n := rnd.Intn(4); n > 0; n-- {
+			k := randToken()
+			switch k {
+			case paramNameDesc, paramNameDur, paramNameCount:
+				continue
+			}
+			m.Extra[k] = randValue()
+		}
+
+		if n := m.sizeOpts(nil); n != len(m.String()) {
+			t.Fatalf("wrong size for %q: %d", m.String(), n)
+		}
+
+		h, err := ParseHeader(m.String())
+		if err != nil {
+			t.Fatalf("error parsing header %q: %s", m.String(), err)
+		}
+		if len(h.Metrics) != 1 {
+			t.Fatalf("expected one metric for %q, got: %#v", m.String(), h.Metrics)
+		}
+		if !reflect.DeepEqual(h.Metrics[0], m) {
+			t.Fatalf("round-trip of %q failed, received, expected:\n\n%#v\n\n%#v",
+				m.String(), h.Metrics[0], m)
+		}
+	}
+}
+
+func TestHeaderAdd_sequence(t *testing.T) {
+	m := &Metric{Name: "sql"}
+
+	// Metrics are only numbered if the header has sequencing enabled
+	var h Header
+	h.Add(m)
+	if m.seq != 0 {
+		t.Fatalf("metric was numbered: %d", m.seq)
+	}
+
+	seqH := Header{sequence: true}
+	seqH.NewMetric("cache")
+	seqH.Add(m)
+	if m.seq != 2 {
+		t.Fatalf("bad seq: %d", m.seq)
+	}
+}
+
+func TestHeaderAddDuration(t *testing.T) {
+	var h Header
+	m := h.AddDuration("sql", 10*time.Millisecond)
+
+	expected := []*Metric{(&Metric{Name: "sql", Duration: 10 * time.Millisecond}).SetMeasured(true)}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", h.Metrics, expected)
+	}
+	if m != h.Metrics[0] {
+		t.Fatal("should return the added metric")
+	}
+}
+
+func TestHeaderAddDuration_nil(t *testing.T) {
+	var h *Header
+	if m := h.AddDuration("sql", time.Millisecond); m == nil || m.Duration != time.Millisecond {
+		t.Fatalf("should return the metric: %#v", m)
+	}
+}
+
+func TestParseHeader_measuredZero(t *testing.T) {
+	h, err := ParseHeader(`a;dur=0,b`)
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+
+	if !h.Metrics[0].Measured() {
+		t.Fatal("dur=0 should be measured")
+	}
+	if h.Metrics[1].Measured() {
+		t.Fatal("missing dur should not be measured")
+	}
+
+	// Round-trip keeps the distinction
+	if actual := h.String(); actual != "a;dur=0,b" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestHeaderAppendFromString(t *testing.T) {
+	var h Header
+	h.AddDuration("local", 5*time.Millisecond)
+	if err := h.AppendFromString(`db;dur=10, cache;desc="Redis"`); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `local;dur=5,db;dur=10,cache;desc=Redis`
+	if actual := h.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+
+	// Malformed input is tolerated the same way as ParseHeader
+	if err := h.AppendFromString(`;;;`); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(h.Metrics) != 3 {
+		t.Fatalf("malformed input should not add metrics: %#v", h.Metrics)
+	}
+}
+
+func TestHeaderAppendFromString_nil(t *testing.T) {
+	var h *Header
+	if err := h.AppendFromString("db;dur=10"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestParseHeader_durationOverflow(t *testing.T) {
+	h, err := ParseHeader(`a;dur=99999999999999999999999999`)
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+
+	if d := h.Metrics[0].Duration; d != time.Duration(math.MaxInt64) {
+		t.Fatalf("expected duration to be clamped: %s", d)
+	}
+}
+
+func TestHeaderSortByDuration(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "a", Duration: 1 * time.Millisecond},
+		{Name: "b", Duration: 5 * time.Millisecond},
+		{Name: "c", Duration: 1 * time.Millisecond},
+		{Name: "d", Duration: 5 * time.Millisecond},
+		{Name: "e", Duration: 1 * time.Millisecond},
+		{Name: "f", Duration: 1 * time.Millisecond},
+	}}
+	h.SortByDuration()
+
+	// Equal durations keep their recorded order
+	var names []string
+	for _, m := range h.Metrics {
+		names = append(names, m.Name)
+	}
+	expected := []string{"b", "d", "a", "c", "e", "f"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", names, expected)
+	}
+}
+
+func TestHeaderSort_nil(t *testing.T) {
+	var h *Header
+	h.SortByDuration()
+}
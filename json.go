@@ -0,0 +1,128 @@
+package servertiming
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// metricJSON is the JSON representation of a Metric. The duration is in
+// fractional milliseconds like the "dur" param and is left out if the
+// metric wasn't measured.
+type metricJSON struct {
+	Name     string            `json:"name"`
+	Desc     string            `json:"desc,omitempty"`
+	Duration *float64          `json:"dur,omitempty"`
+	Count    int               `json:"count,omitempty"`
+	Extra    map[string]string `json:"extra,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. A metric is encoded as an object
+// with the fields "name", "desc", "dur", "count" and "extra". As with the
+// header, "dur" is in milliseconds and only present if the metric was
+// measured. Empty fields are left out.
+func (m *Metric) MarshalJSON() ([]byte, error) {
+	v := metricJSON{
+		Name:  m.Name,
+		Desc:  m.Desc,
+		Count: m.Count,
+		Extra: m.Extra,
+	}
+	if m.Measured() {
+		ms := m.DurationMillis()
+		v.Duration = &ms
+	}
+
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the format written by
+// MarshalJSON.
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	var v metricJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	m.Name = v.Name
+	m.Desc = v.Desc
+	m.Count = v.Count
+	m.Extra = v.Extra
+	m.Duration = 0
+	m.measured = false
+	if v.Duration != nil {
+		// Round since the conversion to milliseconds isn't always exact
+		m.Duration = time.Duration(math.Round(*v.Duration * float64(time.Millisecond)))
+		m.measured = true
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. A header is encoded as an array
+// of its metrics. See Metric.MarshalJSON.
+func (h *Header) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.Metrics == nil {
+		return []byte("[]"), nil
+	}
+
+	return json.Marshal(h.Metrics)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the format written by
+// MarshalJSON. The metrics replace any metrics in the header.
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var metrics []*Metric
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.Metrics = metrics
+	return nil
+}
+
+// EncodeB64Header returns the header as base64 encoded JSON. See
+// MiddlewareOpts.Base64Header.
+//
+// This function is safe to call concurrently.
+func (h *Header) EncodeB64Header() (string, error) {
+	h.Lock()
+	defer h.Unlock()
+	return encodeB64(h.Metrics)
+}
+
+// encodeB64 is the implementation of EncodeB64Header.
+func encodeB64(metrics []*Metric) (string, error) {
+	if metrics == nil {
+		metrics = []*Metric{}
+	}
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeB64Header decodes a header value written with EncodeB64Header,
+// such as from the header set by MiddlewareOpts.Base64Header.
+func DecodeB64Header(s string) (*Header, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var h Header
+	if err := h.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
@@ -0,0 +1,120 @@
+package servertiming
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetricMarshalJSON(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Metric   *Metric
+		Expected string
+	}{
+		{
+			"name only",
+			&Metric{Name: "event"},
+			`{"name":"event"}`,
+		},
+
+		{
+			"all fields",
+			&Metric{
+				Name:     "sql",
+				Desc:     `MySQL; "primary"`,
+				Duration: 1263 * time.Microsecond,
+				Count:    2,
+				Extra:    map[string]string{"cached": ""},
+			},
+			`{"name":"sql","desc":"MySQL; \"primary\"","dur":1.263,"count":2,"extra":{"cached":""}}`,
+		},
+
+		{
+			"measured zero",
+			NewMetricFromDuration("sql", 0),
+			`{"name":"sql","dur":0}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			data, err := json.Marshal(tt.Metric)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if string(data) != tt.Expected {
+				t.Fatalf("received, expected:\n\n%s\n\n%s", data, tt.Expected)
+			}
+
+			var m Metric
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if m.String() != tt.Metric.String() || m.Duration != tt.Metric.Duration {
+				t.Fatalf("round-trip failed, received, expected:\n\n%#v\n\n%#v", &m, tt.Metric)
+			}
+		})
+	}
+}
+
+func TestHeaderMarshalJSON(t *testing.T) {
+	var h Header
+	if data, err := json.Marshal(&h); err != nil || string(data) != "[]" {
+		t.Fatalf("bad: %s %v", data, err)
+	}
+
+	h.AddDuration("sql", 10*time.Millisecond)
+	h.NewMetric("region").WithDesc("us")
+	data, err := json.Marshal(&h)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `[{"name":"sql","dur":10},{"name":"region","desc":"us"}]`
+	if string(data) != expected {
+		t.Fatalf("received, expected:\n\n%s\n\n%s", data, expected)
+	}
+
+	var h2 Header
+	if err := json.Unmarshal(data, &h2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if h2.String() != h.String() {
+		t.Fatalf("round-trip failed: %q != %q", h2.String(), h.String())
+	}
+}
+
+func TestDecodeB64Header(t *testing.T) {
+	h := &Header{Metrics: []*Metric{
+		{Name: "sql", Duration: 100100 * time.Microsecond, Desc: "MySQL; lookup, Server"},
+		{Name: "cache", Extra: map[string]string{"hit": ""}},
+	}}
+
+	s, err := h.EncodeB64Header()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := DecodeB64Header(s)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []*Metric{
+		{Name: "sql", Duration: 100100 * time.Microsecond, Desc: "MySQL; lookup, Server", measured: true},
+		{Name: "cache", Extra: map[string]string{"hit": ""}},
+	}
+	if !reflect.DeepEqual(decoded.Metrics, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", decoded.Metrics, expected)
+	}
+}
+
+func TestDecodeB64Header_invalid(t *testing.T) {
+	for _, s := range []string{"!!!", "bm90IGpzb24="} {
+		if _, err := DecodeB64Header(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
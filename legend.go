@@ -0,0 +1,51 @@
+package servertiming
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// shortenNames replaces the name of every metric with a short name and
+// returns the legend that maps the short names back to the original names.
+// Metrics with the same name get the same short name. The short names are
+// the base 36 index of the first metric with that name, such as "0", "1",
+// ..., "a", "b".
+func shortenNames(metrics []*Metric) map[string]string {
+	legend := make(map[string]string)
+	short := make(map[string]string)
+	for _, m := range metrics {
+		s, ok := short[m.Name]
+		if !ok {
+			s = strconv.FormatInt(int64(len(short)), 36)
+			short[m.Name] = s
+			legend[s] = m.Name
+		}
+
+		m.Name = s
+	}
+
+	return legend
+}
+
+// ApplyLegend restores the metric names of a header that was written with
+// MiddlewareOpts.LegendHeader. legend is the value of the legend header, a
+// JSON object mapping the short names to the original names. Metrics with
+// a name that isn't in the legend are kept as is.
+//
+// This function is safe to call concurrently.
+func (h *Header) ApplyLegend(legend string) error {
+	var names map[string]string
+	if err := json.Unmarshal([]byte(legend), &names); err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for _, m := range h.Metrics {
+		if name, ok := names[m.Name]; ok {
+			m.Name = name
+		}
+	}
+
+	return nil
+}
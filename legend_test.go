@@ -0,0 +1,54 @@
+package servertiming
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestShortenNames(t *testing.T) {
+	var h Header
+	for i := 0; i < 12; i++ {
+		h.NewMetric("metric-" + strconv.Itoa(i))
+	}
+	h.NewMetric("metric-0")
+
+	legend := shortenNames(h.Metrics)
+
+	expected := "0,1,2,3,4,5,6,7,8,9,a,b,0"
+	if actual := h.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+	if len(legend) != 12 || legend["0"] != "metric-0" || legend["b"] != "metric-11" {
+		t.Fatalf("bad legend: %#v", legend)
+	}
+}
+
+func TestHeaderApplyLegend(t *testing.T) {
+	h, err := ParseHeader("0;desc=MySQL;dur=10,1,other;dur=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.ApplyLegend(`{"0":"sql","1":"cache","2":"unused"}`); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var names []string
+	for _, m := range h.Metrics {
+		names = append(names, m.Name)
+	}
+	if expected := []string{"sql", "cache", "other"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", names, expected)
+	}
+}
+
+func TestHeaderApplyLegend_invalid(t *testing.T) {
+	h := &Header{Metrics: []*Metric{{Name: "0"}}}
+	if err := h.ApplyLegend("not json"); err == nil {
+		t.Fatal("expected error")
+	}
+	if h.Metrics[0].Name != "0" {
+		t.Fatalf("metrics should not be modified: %#v", h.Metrics)
+	}
+}
@@ -2,11 +2,17 @@ package servertiming
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// now returns the current time. All times in this package are read with
+// it so that tests can replace it to get exact durations.
+var now = time.Now
+
 // Metric represents a single metric for the Server-Timing header.
 //
 // The easiest way to use the Metric is to use NewMetric and chain it. This
@@ -22,9 +28,12 @@ import (
 //   m.Stop()
 //
 // A metric is expected to represent a single timing event. Therefore,
-// no functions on the struct are safe for concurrency by default. If a single
-// Metric is shared by multiple concurrenty goroutines, you must lock access
-// manually.
+// most functions on the struct are not safe for concurrency. Only Add,
+// Reset and the timer functions Start, StartAt, Stop, StopAt and
+// StopUnlessStopped lock the metric, so that durations can be summed from
+// several goroutines and a pooled metric can be reset safely. If a single
+// Metric is otherwise shared by multiple concurrent goroutines, you must
+// lock access manually. A Metric must not be copied after first use.
 type Metric struct {
 	// Name is the name of the metric. This must be a valid RFC7230 "token"
 	// format. In a gist, this is an alphanumeric string that may contain
@@ -43,11 +52,19 @@ type Metric struct {
 	// RFC7230.
 	Desc string
 
+	// Count is the number of observations this metric represents. This is
+	// useful when a single metric is the sum of multiple timed events, such
+	// as several SQL queries. Values greater than one are sent as the
+	// "count" parameter; zero and one are not sent since a metric
+	// represents a single observation by default.
+	Count int
+
 	// Extra is a set of extra parameters and values to send with the
 	// metric. The specification states that unrecognized parameters are
 	// to be ignored so it should be safe to add additional data here. The
 	// key must be a valid "token" (same syntax as Name) and the value can
-	// be any "token | quoted-string" (same as Desc field).
+	// be any "token | quoted-string" (same as Desc field). An empty value
+	// is sent as a flag with just the key, such as "cached".
 	//
 	// If this map contains a key that would be sent by another field in this
 	// struct (such as "desc"), then this value is prioritized over the
@@ -57,69 +74,545 @@ type Metric struct {
 	// startTime is the time that this metric recording was started if
 	// Start() was called.
 	startTime time.Time
+
+	// stopTime is the time that this metric recording was last stopped
+	// with Stop(). This is reset by Start().
+	stopTime time.Time
+
+	// measured is true if the duration was explicitly measured or set,
+	// even if it is zero. See SetMeasured.
+	measured bool
+
+	// seq is the order this metric was added to a Header in, starting at
+	// 1. This is zero if it wasn't added with the functions on Header.
+	seq int
+
+	// descPrefix is prepended to the description by WithDesc. See
+	// WithDescPrefix.
+	descPrefix string
+
+	// cacheHits and cacheMisses are the counts recorded by Header.CacheHit
+	// and Header.CacheMiss.
+	cacheHits, cacheMisses int
+
+	// mu is held while the metric is reset, while Add modifies the
+	// duration or while its timer is started or stopped.
+	mu sync.Mutex
 }
 
 // WithDesc is a chaining-friendly helper to set the Desc field on the Metric.
+// If the metric was created with NewMetricFromContext from a context with
+// a prefix set by WithDescPrefix, a non-empty desc is prefixed with it.
 func (m *Metric) WithDesc(desc string) *Metric {
+	if desc != "" {
+		desc = m.descPrefix + desc
+	}
+
 	m.Desc = desc
 	return m
 }
 
+// Observe adds the duration d to this metric and increments Count. This
+// can be used to aggregate multiple timed events into a single metric.
+// If Count is zero and Duration is already set, the existing Duration is
+// counted as one prior observation.
+func (m *Metric) Observe(d time.Duration) *Metric {
+	if m.Count == 0 && m.Duration > 0 {
+		m.Count = 1
+	}
+
+	m.Duration += d
+	m.Count++
+	m.measured = true
+	return m
+}
+
+// Add adds d to Duration without affecting the timer started with Start.
+// This can be used to fold several separately measured operations into a
+// single metric. Unlike Observe, Count is not changed.
+//
+// This function is safe to call concurrently with other calls to Add, so
+// durations measured in several goroutines can be summed into one metric.
+func (m *Metric) Add(d time.Duration) *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Duration += d
+	m.measured = true
+	return m
+}
+
+// NewMetricFromDuration creates a new Metric with an already known
+// duration, such as a timing reported by another system. The metric is not
+// added to any header. To create and add it in one step, use
+// Header.AddDuration.
+func NewMetricFromDuration(name string, d time.Duration) *Metric {
+	return &Metric{Name: name, Duration: d, measured: true}
+}
+
+// DurationMillis returns Duration as fractional milliseconds. This is the
+// same value that is sent as the "dur" param in the header.
+func (m *Metric) DurationMillis() float64 {
+	return durationMillis(m.Duration)
+}
+
+// SetDurationMillis sets Duration from a fractional millisecond value.
+// This is the inverse of DurationMillis and is useful when importing
+// timings from systems that report milliseconds.
+func (m *Metric) SetDurationMillis(ms float64) {
+	m.Duration = time.Duration(ms * float64(time.Millisecond))
+	m.measured = true
+}
+
+// SetMeasured sets whether the Duration of this metric was measured. A
+// metric with a non-zero Duration is always considered measured, so this
+// only matters for a zero Duration: a measured metric is sent with
+// "dur=0" while an unmeasured one, such as a metric that only carries a
+// description, is sent without "dur".
+//
+// Stop, Observe and SetDurationMillis mark the metric as measured, so
+// this is usually only needed when setting the Duration field directly.
+func (m *Metric) SetMeasured(measured bool) *Metric {
+	m.measured = measured
+	return m
+}
+
+// Measured reports whether the duration of this metric was measured. See
+// SetMeasured.
+func (m *Metric) Measured() bool {
+	return m.measured || m.Duration > 0
+}
+
+// Running reports whether the metric was started with Start or StartAt
+// and hasn't been stopped since.
+func (m *Metric) Running() bool {
+	return !m.startTime.IsZero() && m.stopTime.IsZero()
+}
+
+// WithExtra is a chaining-friendly helper to set a single key in the
+// Extra field on the Metric. The Extra map is allocated if necessary.
+func (m *Metric) WithExtra(key, value string) *Metric {
+	if m.Extra == nil {
+		m.Extra = make(map[string]string)
+	}
+
+	m.Extra[key] = value
+	return m
+}
+
+// WithExtraIf is like WithExtra but only sets the key if cond is true.
+// This keeps chains readable when an annotation is conditional:
+//
+//	m.Stop().WithExtraIf(m.Duration > time.Second, "slow", "true")
+func (m *Metric) WithExtraIf(cond bool, key, value string) *Metric {
+	if cond {
+		m.WithExtra(key, value)
+	}
+
+	return m
+}
+
+// Annotate is a chaining-friendly helper to merge all of the given
+// key/value pairs into the Extra field on the Metric, overwriting any
+// existing keys. The Extra map is allocated if necessary.
+func (m *Metric) Annotate(kv map[string]string) *Metric {
+	for k, v := range kv {
+		m.WithExtra(k, v)
+	}
+
+	return m
+}
+
+// SetExtra is a chaining-friendly helper to replace the Extra field on the
+// Metric with a copy of extra, so later changes to extra don't affect the
+// metric. A nil extra clears Extra.
+func (m *Metric) SetExtra(extra map[string]string) *Metric {
+	m.Extra = nil
+	if extra != nil {
+		m.Extra = make(map[string]string, len(extra))
+	}
+
+	return m.Annotate(extra)
+}
+
+// WithError is a chaining-friendly helper to annotate the Metric with
+// whether the operation it measures failed. If err is non-nil, the
+// "error" extra param is set to "true". If err is nil, this does nothing.
+//
+// The error message itself is not sent since the header is visible to
+// clients and error messages may contain sensitive information.
+func (m *Metric) WithError(err error) *Metric {
+	if err == nil {
+		return m
+	}
+
+	return m.WithExtra(paramNameError, "true")
+}
+
+// ExtraInt returns the extra param key parsed as an integer. ok is false
+// if the param isn't set or isn't a valid integer.
+func (m *Metric) ExtraInt(key string) (v int, ok bool) {
+	s, ok := m.Extra[key]
+	if !ok {
+		return 0, false
+	}
+
+	v, err := strconv.Atoi(s)
+	return v, err == nil
+}
+
+// ExtraFloat returns the extra param key parsed as a float. ok is false if
+// the param isn't set or isn't a valid float.
+func (m *Metric) ExtraFloat(key string) (v float64, ok bool) {
+	s, ok := m.Extra[key]
+	if !ok {
+		return 0, false
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// ExtraBool returns the extra param key parsed with strconv.ParseBool. A
+// param without a value, such as "cached" in "sql;cached", is a flag and
+// is true. ok is false if the param isn't set or isn't a valid boolean.
+func (m *Metric) ExtraBool(key string) (v bool, ok bool) {
+	s, ok := m.Extra[key]
+	if !ok {
+		return false, false
+	}
+	if s == "" {
+		return true, true
+	}
+
+	v, err := strconv.ParseBool(s)
+	return v, err == nil
+}
+
+// Validate checks that the metric can be encoded into a header value that
+// clients will accept. The name and extra param keys must be valid RFC7230
+// tokens and the description and extra param values must not contain
+// control characters.
+func (m *Metric) Validate() error {
+	if !isToken(m.Name) {
+		return fmt.Errorf("metric name %q is not a valid token", m.Name)
+	}
+
+	if !isQuotable(m.Desc) {
+		return fmt.Errorf("metric %q: desc contains invalid characters", m.Name)
+	}
+
+	for k, v := range m.Extra {
+		if !isToken(k) {
+			return fmt.Errorf("metric %q: param name %q is not a valid token", m.Name, k)
+		}
+
+		if !isQuotable(v) {
+			return fmt.Errorf("metric %q: param %q contains invalid characters", m.Name, k)
+		}
+	}
+
+	return nil
+}
+
+// clone returns a copy of the metric, including a copy of Extra.
+func (m *Metric) clone() *Metric {
+	c := &Metric{
+		Name:        m.Name,
+		Duration:    m.Duration,
+		Desc:        m.Desc,
+		Count:       m.Count,
+		startTime:   m.startTime,
+		stopTime:    m.stopTime,
+		measured:    m.measured,
+		seq:         m.seq,
+		descPrefix:  m.descPrefix,
+		cacheHits:   m.cacheHits,
+		cacheMisses: m.cacheMisses,
+	}
+	if m.Extra != nil {
+		c.Extra = make(map[string]string, len(m.Extra))
+		for k, v := range m.Extra {
+			c.Extra[k] = v
+		}
+	}
+
+	return c
+}
+
+// Reset clears the metric so that it can be reused, such as by
+// ReleaseMetric. The metric is cleared under its lock, so this is safe to
+// call concurrently with the other functions that lock it, but the caller
+// must ensure nothing else is still using the metric.
+func (m *Metric) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Name = ""
+	m.Duration = 0
+	m.Desc = ""
+	m.Count = 0
+	m.Extra = nil
+	m.startTime = time.Time{}
+	m.stopTime = time.Time{}
+	m.measured = false
+	m.seq = 0
+	m.descPrefix = ""
+	m.cacheHits = 0
+	m.cacheMisses = 0
+}
+
+// observations returns the number of observations m represents. A metric
+// without an explicit Count is a single observation.
+func observations(m *Metric) int {
+	if m.Count < 1 {
+		return 1
+	}
+
+	return m.Count
+}
+
 // Start starts a timer for recording the duration of some task. This must
 // be paired with a Stop call to set the duration. Calling this again will
-// reset the start time for a subsequent Stop call.
+// reset the start time for a subsequent Stop call, discarding the previous
+// start time. The Duration recorded by an earlier Stop is kept until the
+// next Stop.
+//
+// The start and stop times are read with time.Now, so the duration is
+// measured with the monotonic clock and isn't affected by changes to the
+// wall clock during the request, such as from NTP.
 func (m *Metric) Start() *Metric {
-	m.startTime = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.startTime = now()
+	m.stopTime = time.Time{}
 	return m
 }
 
 // Stop ends the timer started with Start and records the duration in the
 // Duration field. Calling this multiple times will modify the Duration based
-// on the last time Start was called.
+// on the last time Start was called, so each call records the time since
+// that Start rather than since the previous Stop. Use StopUnlessStopped to
+// only record the first Stop.
 //
-// If Start was never called, this function has zero effect.
+// If Start was never called, this function has zero effect and an existing
+// Duration is kept.
 func (m *Metric) Stop() *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stop()
+}
+
+// stop is the implementation of Stop. The lock must be held.
+func (m *Metric) stop() *Metric {
 	// Only record if we have a start time set with Start()
 	if !m.startTime.IsZero() {
-		m.Duration = time.Since(m.startTime)
+		m.stopTime = now()
+		m.Duration = m.stopTime.Sub(m.startTime)
+		m.measured = true
+	}
+
+	return m
+}
+
+// StartAt is like Start but uses the given time as the start time. This
+// is useful when the start of an operation was recorded elsewhere.
+func (m *Metric) StartAt(t time.Time) *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.startTime = t
+	m.stopTime = time.Time{}
+	return m
+}
+
+// StopAt is like Stop but uses the given time as the stop time. If Start
+// or StartAt was never called, this function has zero effect.
+//
+// The duration only uses the monotonic clock if both the start and stop
+// time have a monotonic clock reading, such as times from time.Now. For
+// other times, such as ones parsed or created with time.Unix, it is the
+// difference of the wall clock times. That can be negative if the wall
+// clock was set back in between, so a negative duration is recorded as
+// zero.
+func (m *Metric) StopAt(t time.Time) *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.startTime.IsZero() {
+		m.stopTime = t
+		m.Duration = m.stopTime.Sub(m.startTime)
+		if m.Duration < 0 {
+			m.Duration = 0
+		}
+		m.measured = true
 	}
 
 	return m
 }
 
-// String returns the valid Server-Timing metric entry value.
+// WithInterval is a chaining-friendly helper to record an interval that
+// is already known, such as one from a trace span. It sets the start and
+// stop time of the metric and records the duration between them.
+func (m *Metric) WithInterval(start, end time.Time) *Metric {
+	return m.StartAt(start).StopAt(end)
+}
+
+// StopUnlessStopped is like Stop but only records the duration if the
+// timer hasn't been stopped since the last call to Start. It returns the
+// recorded Duration. This is useful to stop a metric early on one code
+// path while a deferred call ensures it is stopped on all others:
+//
+//	m := timing.NewMetric("sql").Start()
+//	defer m.StopUnlessStopped()
+//	// ...
+//	m.Stop()
+//
+// A call to Stop after StopUnlessStopped is not affected by this and
+// still records a new duration from the last Start.
+func (m *Metric) StopUnlessStopped() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopTime.IsZero() {
+		m.stop()
+	}
+
+	return m.Duration
+}
+
+// String returns the valid Server-Timing metric entry value. This is also
+// what the %v and %s verbs of the fmt package print, while %#v prints the
+// fields as described by GoString.
 func (m *Metric) String() string {
+	return m.StringOpts(nil)
+}
+
+// StringOpts returns the valid Server-Timing metric entry value encoded
+// according to opts. opts may be nil to use the defaults.
+func (m *Metric) StringOpts(opts *EncodeOpts) string {
 	// Begin building parts, expected capacity is length of extra
-	// fields plus id, desc, dur.
-	parts := make([]string, 1, len(m.Extra)+3)
+	// fields plus id, desc, dur, count.
+	parts := make([]string, 1, len(m.Extra)+4)
 	parts[0] = m.Name
 
-	// Description
+	// Description and duration, in the configured order
+	var desc, dur string
 	if _, ok := m.Extra[paramNameDesc]; !ok && m.Desc != "" {
-		parts = append(parts, headerEncodeParam(paramNameDesc, m.Desc))
+		desc = headerEncodeParam(paramNameDesc, m.Desc)
+	}
+	if _, ok := m.Extra[paramNameDur]; !ok && m.Measured() {
+		dur = headerEncodeParam(paramNameDur, opts.formatDuration(m.Duration))
+	}
+	if opts != nil && opts.DurFirst {
+		desc, dur = dur, desc
+	}
+	for _, v := range [...]string{desc, dur} {
+		if v != "" {
+			parts = append(parts, v)
+		}
 	}
 
-	// Duration
-	if _, ok := m.Extra[paramNameDur]; !ok && m.Duration > 0 {
-		parts = append(parts, headerEncodeParam(
-			paramNameDur,
-			strconv.FormatFloat(float64(m.Duration)/float64(time.Millisecond), 'f', -1, 64),
-		))
+	// Count
+	if _, ok := m.Extra[paramNameCount]; !ok && m.Count > 1 {
+		parts = append(parts, headerEncodeParam(paramNameCount, strconv.Itoa(m.Count)))
 	}
 
-	// All remaining extra params
-	for k, v := range m.Extra {
+	// All remaining extra params. Params with an empty value are flags
+	// and are sent as just the name.
+	for _, k := range m.extraKeys(opts != nil && opts.SortExtra) {
+		v := m.Extra[k]
+		if v == "" {
+			parts = append(parts, k)
+			continue
+		}
+
 		parts = append(parts, headerEncodeParam(k, v))
 	}
 
 	return strings.Join(parts, ";")
 }
 
+// sizeOpts returns the length in bytes of StringOpts(opts). This must be
+// kept in sync with StringOpts.
+func (m *Metric) sizeOpts(opts *EncodeOpts) int {
+	n := len(m.Name)
+	if _, ok := m.Extra[paramNameDesc]; !ok && m.Desc != "" {
+		n += 1 + headerEncodeParamSize(paramNameDesc, m.Desc)
+	}
+	if _, ok := m.Extra[paramNameDur]; !ok && m.Measured() {
+		n += 1 + headerEncodeParamSize(paramNameDur, opts.formatDuration(m.Duration))
+	}
+	if _, ok := m.Extra[paramNameCount]; !ok && m.Count > 1 {
+		n += 1 + headerEncodeParamSize(paramNameCount, strconv.Itoa(m.Count))
+	}
+	for k, v := range m.Extra {
+		n++
+		if v == "" {
+			n += len(k)
+			continue
+		}
+
+		n += headerEncodeParamSize(k, v)
+	}
+
+	return n
+}
+
+// extraKeys returns the keys of Extra, optionally sorted.
+func (m *Metric) extraKeys(sorted bool) []string {
+	keys := make([]string, 0, len(m.Extra))
+	for k := range m.Extra {
+		keys = append(keys, k)
+	}
+
+	if sorted {
+		sort.Strings(keys)
+	}
+
+	return keys
+}
+
 // GoString is needed for fmt.GoStringer so %v works on pointer value.
 func (m *Metric) GoString() string {
 	if m == nil {
 		return "nil"
 	}
 
-	return fmt.Sprintf("*%#v", *m)
+	// The struct can't be formatted directly with %#v since that would
+	// copy the lock, so the exported fields are formatted individually.
+	return fmt.Sprintf(
+		"*servertiming.Metric{Name:%q, Duration:%d, Desc:%q, Count:%d, Extra:%#v}",
+		m.Name, m.Duration, m.Desc, m.Count, m.Extra)
+}
+
+// MarshalText implements encoding.TextMarshaler. The text is the same as
+// String.
+func (m *Metric) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It parses a single
+// Server-Timing metric entry, such as one written by MarshalText, the same
+// way as ParseHeader. Separators within quoted params are part of the
+// value, so `sql;desc="a, b"` is a single metric. It is an error if text
+// doesn't contain exactly one metric.
+func (m *Metric) UnmarshalText(text []byte) error {
+	h, err := ParseHeader(string(text))
+	if err != nil {
+		return err
+	}
+	if len(h.Metrics) != 1 {
+		return fmt.Errorf("expected a single metric, got %d", len(h.Metrics))
+	}
+
+	parsed := h.Metrics[0]
+	m.Name = parsed.Name
+	m.Desc = parsed.Desc
+	m.Duration = parsed.Duration
+	m.Count = parsed.Count
+	m.Extra = parsed.Extra
+	m.measured = parsed.measured
+	return nil
 }
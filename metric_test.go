@@ -1,6 +1,10 @@
 package servertiming
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -23,6 +27,28 @@ func TestMetric_startStop(t *testing.T) {
 	}
 }
 
+// setNow replaces the clock used by the package with fn until the test
+// and its subtests complete.
+func setNow(t testing.TB, fn func() time.Time) {
+	old := now
+	now = fn
+	t.Cleanup(func() { now = old })
+}
+
+func TestMetric_startStopNow(t *testing.T) {
+	cur := time.Unix(0, 0)
+	setNow(t, func() time.Time { return cur })
+
+	var m Metric
+	m.Start()
+	cur = cur.Add(1263 * time.Microsecond)
+	m.Stop()
+
+	if m.Duration != 1263*time.Microsecond {
+		t.Fatalf("bad: %s", m.Duration)
+	}
+}
+
 func TestMetric_stopNoStart(t *testing.T) {
 	var m Metric
 	m.Stop()
@@ -32,3 +58,562 @@ func TestMetric_stopNoStart(t *testing.T) {
 		t.Fatal("duration should not be set")
 	}
 }
+
+func TestMetric_stopNoStartKeepsDuration(t *testing.T) {
+	m := Metric{Duration: 10 * time.Millisecond}
+	m.Stop()
+
+	if m.Duration != 10*time.Millisecond {
+		t.Fatalf("bad duration: %s", m.Duration)
+	}
+}
+
+func TestMetric_startTwice(t *testing.T) {
+	var m Metric
+	m.Start()
+	time.Sleep(20 * time.Millisecond)
+
+	// The second Start discards the first start time
+	m.Start()
+	m.Stop()
+	if m.Duration >= 20*time.Millisecond {
+		t.Fatalf("duration should be from the last Start: %s", m.Duration)
+	}
+
+	// Start doesn't clear the recorded duration
+	d := m.Duration
+	m.Start()
+	if m.Duration != d {
+		t.Fatalf("duration should be kept: %s != %s", m.Duration, d)
+	}
+}
+
+func TestMetric_stopTwice(t *testing.T) {
+	var m Metric
+	m.Start()
+	m.Stop()
+	d := m.Duration
+
+	// The second Stop records the time since Start, not since the first Stop
+	time.Sleep(10 * time.Millisecond)
+	m.Stop()
+	if m.Duration < d+10*time.Millisecond {
+		t.Fatalf("duration should be from Start: %s", m.Duration)
+	}
+}
+
+func TestMetric_observe(t *testing.T) {
+	var m Metric
+	m.Observe(10 * time.Millisecond)
+	m.Observe(20 * time.Millisecond)
+	m.Observe(30 * time.Millisecond)
+
+	if m.Duration != 60*time.Millisecond {
+		t.Fatalf("bad duration: %s", m.Duration)
+	}
+	if m.Count != 3 {
+		t.Fatalf("bad count: %d", m.Count)
+	}
+}
+
+func TestMetric_observeExistingDuration(t *testing.T) {
+	m := Metric{Duration: 10 * time.Millisecond}
+	m.Observe(20 * time.Millisecond)
+
+	if m.Duration != 30*time.Millisecond {
+		t.Fatalf("bad duration: %s", m.Duration)
+	}
+	if m.Count != 2 {
+		t.Fatalf("bad count: %d", m.Count)
+	}
+}
+
+func TestMetric_add(t *testing.T) {
+	var m Metric
+	m.Add(0)
+	if !m.Measured() {
+		t.Fatal("should be measured")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Add(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	if m.Duration != 10*time.Millisecond {
+		t.Fatalf("bad duration: %s", m.Duration)
+	}
+	if m.Count != 0 {
+		t.Fatalf("bad count: %d", m.Count)
+	}
+}
+
+func TestMetric_text(t *testing.T) {
+	for _, tt := range headerCases {
+		if len(tt.Metrics) != 1 {
+			continue
+		}
+
+		t.Run(tt.HeaderValue, func(t *testing.T) {
+			text, err := tt.Metrics[0].MarshalText()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if string(text) != tt.HeaderValue {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", text, tt.HeaderValue)
+			}
+
+			var m Metric
+			if err := m.UnmarshalText(text); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if m.GoString() != tt.Metrics[0].GoString() {
+				t.Fatalf("received, expected:\n\n%#v\n\n%#v", &m, tt.Metrics[0])
+			}
+		})
+	}
+}
+
+func TestMetric_unmarshalTextInvalid(t *testing.T) {
+	for _, text := range []string{"", "a,b", `a;desc="x",b`, ";desc=x"} {
+		var m Metric
+		if err := m.UnmarshalText([]byte(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestMetric_withExtra(t *testing.T) {
+	var m Metric
+	m.WithExtra("cache", "hit").WithExtra("region", "us")
+
+	expected := map[string]string{"cache": "hit", "region": "us"}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", m.Extra, expected)
+	}
+}
+
+func TestMetric_withExtraIf(t *testing.T) {
+	var m Metric
+	if m.WithExtraIf(false, "slow", "true") != &m {
+		t.Fatal("should return receiver")
+	}
+	if m.Extra != nil {
+		t.Fatalf("extra should not be set: %#v", m.Extra)
+	}
+
+	m.WithExtraIf(true, "slow", "true").WithExtraIf(false, "cache", "hit")
+	expected := map[string]string{"slow": "true"}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", m.Extra, expected)
+	}
+}
+
+func TestMetric_withError(t *testing.T) {
+	var m Metric
+	if m.WithError(nil) != &m {
+		t.Fatal("should return receiver")
+	}
+	if m.Extra != nil {
+		t.Fatalf("extra should not be set: %#v", m.Extra)
+	}
+
+	m.WithError(errors.New("boom"))
+	if m.Extra["error"] != "true" {
+		t.Fatalf("error should be set: %#v", m.Extra)
+	}
+
+	m.Name = "sql"
+	if actual := m.String(); actual != `sql;error=true` {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestMetric_extraGetters(t *testing.T) {
+	h, err := ParseHeader(`sql;rows=42;ratio=0.5;cache=true;cached;bad=abc`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.Metrics[0]
+
+	if v, ok := m.ExtraInt("rows"); !ok || v != 42 {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+	if v, ok := m.ExtraFloat("ratio"); !ok || v != 0.5 {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+	if v, ok := m.ExtraFloat("rows"); !ok || v != 42 {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+	if v, ok := m.ExtraBool("cache"); !ok || !v {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+	if v, ok := m.ExtraBool("cached"); !ok || !v {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+
+	// Invalid and missing values
+	if _, ok := m.ExtraInt("ratio"); ok {
+		t.Fatal("should not be ok")
+	}
+	if _, ok := m.ExtraFloat("bad"); ok {
+		t.Fatal("should not be ok")
+	}
+	if _, ok := m.ExtraBool("bad"); ok {
+		t.Fatal("should not be ok")
+	}
+	if _, ok := m.ExtraInt("missing"); ok {
+		t.Fatal("should not be ok")
+	}
+	if _, ok := (&Metric{}).ExtraBool("missing"); ok {
+		t.Fatal("should not be ok")
+	}
+}
+
+func TestMetric_format(t *testing.T) {
+	m := &Metric{Name: "sql", Duration: 10 * time.Millisecond, Desc: "MySQL"}
+
+	cases := []struct {
+		Format   string
+		Expected string
+	}{
+		{"%v", "sql;desc=MySQL;dur=10"},
+		{"%s", "sql;desc=MySQL;dur=10"},
+		{"%q", `"sql;desc=MySQL;dur=10"`},
+		{"%#v", `*servertiming.Metric{Name:"sql", Duration:10000000, Desc:"MySQL", Count:0, Extra:map[string]string(nil)}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Format, func(t *testing.T) {
+			if actual := fmt.Sprintf(tt.Format, m); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+
+	var nilMetric *Metric
+	if actual := fmt.Sprintf("%#v", nilMetric); actual != "nil" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestMetric_durationMillis(t *testing.T) {
+	m := Metric{Duration: 100100 * time.Microsecond}
+	if actual := m.DurationMillis(); actual != 100.1 {
+		t.Fatalf("bad: %v", actual)
+	}
+}
+
+func TestMetric_validate(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Metric *Metric
+		Err    bool
+	}{
+		{
+			"valid",
+			&Metric{Name: "sql-1", Desc: "MySQL; lookup\tServer", Extra: map[string]string{"rows": "42"}},
+			false,
+		},
+
+		{
+			"empty name",
+			&Metric{},
+			true,
+		},
+
+		{
+			"name with space",
+			&Metric{Name: "sql 1"},
+			true,
+		},
+
+		{
+			"name with separator",
+			&Metric{Name: "sql;1"},
+			true,
+		},
+
+		{
+			"desc with newline",
+			&Metric{Name: "sql", Desc: "line\nbreak"},
+			true,
+		},
+
+		{
+			"extra key not a token",
+			&Metric{Name: "sql", Extra: map[string]string{"a=b": "c"}},
+			true,
+		},
+
+		{
+			"extra value with control character",
+			&Metric{Name: "sql", Extra: map[string]string{"a": "\x00"}},
+			true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := tt.Metric.Validate()
+			if (err != nil) != tt.Err {
+				t.Fatalf("expected error: %v, got: %v", tt.Err, err)
+			}
+		})
+	}
+}
+
+func TestMetric_stopUnlessStopped(t *testing.T) {
+	var m Metric
+	m.Start()
+	time.Sleep(10 * time.Millisecond)
+	d := m.StopUnlessStopped()
+	if d == 0 || d != m.Duration {
+		t.Fatalf("should return recorded duration: %s != %s", d, m.Duration)
+	}
+
+	// Already stopped, so this should not modify the duration
+	time.Sleep(10 * time.Millisecond)
+	if d2 := m.StopUnlessStopped(); d2 != d {
+		t.Fatalf("duration should not change: %s != %s", d2, d)
+	}
+
+	// Stop still records a new duration from the last Start
+	time.Sleep(10 * time.Millisecond)
+	m.Stop()
+	if m.Duration <= d {
+		t.Fatalf("Stop should record a new duration: %s <= %s", m.Duration, d)
+	}
+
+	// Start resets the stop so StopUnlessStopped records again
+	m.Start()
+	if d3 := m.StopUnlessStopped(); d3 >= d {
+		t.Fatalf("should record a new duration after Start: %s", d3)
+	}
+}
+
+func TestMetric_stopUnlessStoppedNoStart(t *testing.T) {
+	var m Metric
+	if d := m.StopUnlessStopped(); d != 0 {
+		t.Fatalf("duration should not be set: %s", d)
+	}
+}
+
+func TestMetric_running(t *testing.T) {
+	var m Metric
+	if m.Running() {
+		t.Fatal("should not be running before Start")
+	}
+
+	m.Start()
+	if !m.Running() {
+		t.Fatal("should be running after Start")
+	}
+
+	m.Stop()
+	if m.Running() {
+		t.Fatal("should not be running after Stop")
+	}
+
+	m.StartAt(time.Now())
+	if !m.Running() {
+		t.Fatal("should be running after StartAt")
+	}
+}
+
+func TestMetric_setDurationMillis(t *testing.T) {
+	var m Metric
+	m.SetDurationMillis(100.1)
+	if m.Duration != 100100*time.Microsecond {
+		t.Fatalf("bad: %s", m.Duration)
+	}
+	if m.DurationMillis() != 100.1 {
+		t.Fatalf("bad: %v", m.DurationMillis())
+	}
+}
+
+func TestMetric_measured(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Metric   *Metric
+		Measured bool
+		Expected string
+	}{
+		{
+			"unmeasured",
+			&Metric{Name: "event"},
+			false,
+			"event",
+		},
+
+		{
+			"non-zero duration",
+			&Metric{Name: "sql", Duration: time.Millisecond},
+			true,
+			"sql;dur=1",
+		},
+
+		{
+			"measured zero",
+			(&Metric{Name: "sql"}).SetMeasured(true),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"set millis zero",
+			func() *Metric {
+				m := &Metric{Name: "sql"}
+				m.SetDurationMillis(0)
+				return m
+			}(),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"from zero duration",
+			NewMetricFromDuration("sql", 0),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"stop without start",
+			(&Metric{Name: "sql"}).Stop(),
+			false,
+			"sql",
+		},
+
+		{
+			"desc only",
+			(&Metric{Name: "region"}).WithDesc("us"),
+			false,
+			"region;desc=us",
+		},
+
+		{
+			"zero interval",
+			func() *Metric {
+				now := time.Now()
+				return (&Metric{Name: "sql"}).WithInterval(now, now)
+			}(),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"observe zero",
+			(&Metric{Name: "sql"}).Observe(0),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"add zero",
+			(&Metric{Name: "sql"}).Add(0),
+			true,
+			"sql;dur=0",
+		},
+
+		{
+			"reset",
+			func() *Metric {
+				m := NewMetricFromDuration("sql", 0)
+				m.Reset()
+				m.Name = "sql"
+				return m
+			}(),
+			false,
+			"sql",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			if actual := tt.Metric.Measured(); actual != tt.Measured {
+				t.Fatalf("expected measured: %v", tt.Measured)
+			}
+			if actual := tt.Metric.String(); actual != tt.Expected {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", actual, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestMetric_annotate(t *testing.T) {
+	m := (&Metric{}).WithExtra("cache", "miss")
+	m.Annotate(map[string]string{"cache": "hit", "region": "us"}).Annotate(nil)
+
+	expected := map[string]string{"cache": "hit", "region": "us"}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", m.Extra, expected)
+	}
+}
+
+func TestMetric_setExtra(t *testing.T) {
+	extra := map[string]string{"region": "us"}
+	m := (&Metric{}).WithExtra("cache", "miss").SetExtra(extra)
+	extra["region"] = "eu"
+
+	expected := map[string]string{"region": "us"}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", m.Extra, expected)
+	}
+
+	if m.SetExtra(nil).Extra != nil {
+		t.Fatalf("should clear extra: %#v", m.Extra)
+	}
+}
+
+func TestMetric_withInterval(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(150 * time.Millisecond)
+
+	var m Metric
+	if m.WithInterval(start, end) != &m {
+		t.Fatal("should return receiver")
+	}
+
+	if m.Duration != 150*time.Millisecond {
+		t.Fatalf("bad duration: %s", m.Duration)
+	}
+	if !m.startTime.Equal(start) || !m.stopTime.Equal(end) {
+		t.Fatalf("bad interval: %s - %s", m.startTime, m.stopTime)
+	}
+}
+
+func TestMetric_monotonic(t *testing.T) {
+	var m Metric
+	m.Start().Stop()
+
+	// Round(0) strips the monotonic clock reading, so the times only
+	// differ if they have one.
+	if m.startTime == m.startTime.Round(0) || m.stopTime == m.stopTime.Round(0) {
+		t.Fatalf("times should have a monotonic clock reading: %s - %s", m.startTime, m.stopTime)
+	}
+}
+
+func TestMetric_stopAtBeforeStart(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A time from the wall clock after it was set back
+	var m Metric
+	m.StartAt(start).StopAt(start.Add(-time.Second))
+	if m.Duration != 0 || !m.Measured() {
+		t.Fatalf("duration should be zero: %s", m.Duration)
+	}
+}
+
+func TestMetric_stopAtNoStart(t *testing.T) {
+	var m Metric
+	m.StopAt(time.Now())
+	if m.Duration != 0 || m.Measured() {
+		t.Fatal("duration should not be set")
+	}
+}
@@ -1,7 +1,18 @@
 package servertiming
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/felixge/httpsnoop"
 )
@@ -9,7 +20,321 @@ import (
 // MiddlewareOpts are options for the Middleware.
 type MiddlewareOpts struct {
 	// Don’t write headers in the request. Metrics are still gathered though.
+	// The *Header from FromContext is usable as normal so the metrics can
+	// be reported some other way, such as logging them.
 	DisableHeaders bool
+
+	// Enabled, if set, is called for every request and the middleware is
+	// skipped entirely if it returns false. The handler is called as is,
+	// so FromContext returns nil unless an outer Middleware added a
+	// *Header. This allows timings to be toggled at runtime, such as with
+	// a feature flag. It should be cheap since it is called per request.
+	Enabled func() bool
+
+	// FirstN, if positive, only writes the header for the first N
+	// requests handled by this Middleware. Metrics are still gathered for
+	// later requests, the same as with DisableHeaders. This is useful to
+	// inspect cold starts without exposing timings afterwards.
+	FirstN int
+
+	// Dedup collapses metrics with the same name into a single metric
+	// before the header is written, summing their durations and counts.
+	// This keeps the header compact for responses that record many
+	// fine-grained metrics under repeated names. The metrics in the
+	// request context are not modified.
+	Dedup bool
+
+	// DedupMerge, if set, combines the extra params of the metrics that
+	// Dedup collapses instead of keeping only those of the first metric.
+	// See Header.DedupMerge. This has no effect unless Dedup is set.
+	DedupMerge func(dst, src map[string]string)
+
+	// NameNormalizer, if set, is called with the name of every recorded
+	// metric before the header is written and the result is used as the
+	// name instead. This can enforce a naming convention centrally, such
+	// as strings.ToLower so that "SQL-1" and "sql-1" are sent the same.
+	// The metrics in the request context are not modified.
+	//
+	// Normalization happens before Dedup, so metrics that were meant to be
+	// distinct but normalize to the same name are merged when both are
+	// set.
+	NameNormalizer func(string) string
+
+	// EmitNames, if non-empty, is the list of metric names that are
+	// written to the header. All other metrics are left out, which is a
+	// simple way to control exactly which timings are exposed to clients.
+	// The metrics in the request context are not modified.
+	//
+	// This applies to every metric, including those added by other
+	// options such as Version, so their names must be listed as well to
+	// be sent.
+	EmitNames []string
+
+	// Deterministic sorts the metrics by name and the extra params of
+	// each metric by key before the header is written. Identical metrics
+	// then always produce a byte-identical header value, which matters
+	// for caches and CDNs that vary or hash on response headers. Metrics
+	// with the same name keep the order they were recorded in.
+	Deterministic bool
+
+	// SortByStop orders the metrics by the time they were stopped, most
+	// recent first, so the header reads from what happened last. Only
+	// metrics timed with Stop or StopAt have a stop time. Metrics without
+	// one, such as those with a Duration set directly, are placed last.
+	// Metrics with the same stop time keep their order, so combined with
+	// Deterministic they are sorted by name.
+	SortByStop bool
+
+	// Timeline adds a "start" param to every metric that was timed with
+	// Start, containing the milliseconds between the start of the request
+	// and the start of the metric. Together with "dur" this allows the
+	// metrics to be rendered as a waterfall. This increases the header
+	// size so it is off by default.
+	//
+	// Like the other options that control the header, this only has an
+	// effect on the outermost Middleware when nested. See Middleware.
+	Timeline bool
+
+	// Sequence adds a "seq" param to every metric with the order it was
+	// added to the *Header in, starting at 1. This allows clients to
+	// recover the order the metrics were created in after they were
+	// reordered, such as with Deterministic. Only metrics added with the
+	// functions on Header, such as NewMetric and Add, are numbered. The
+	// number is only recorded in metrics with this set, so metrics added
+	// without it are never modified.
+	Sequence bool
+
+	// Percent adds a "pct" param to every metric with a duration,
+	// containing its share of the total request time as a percentage with
+	// one decimal. The total is the time from the start of the request to
+	// when the header is written. This increases the header size so it is
+	// off by default.
+	//
+	// The percentages of concurrent metrics can add up to more than 100.
+	// Use Header.WallClock to find how much of the request they covered.
+	//
+	// Like the other options that control the header, this only has an
+	// effect on the outermost Middleware when nested. See Middleware.
+	Percent bool
+
+	// Budget, if positive, is the maximum number of metrics recorded for
+	// a request. Once it is used up, functions such as NewMetric and Add
+	// still return a usable *Metric but it isn't recorded. This protects
+	// against a header growing without bound, such as from a metric
+	// created in a loop, without instrumented code having to check
+	// anything. Metrics added by the middleware itself, such as with
+	// CaptureBodyWrite, count towards the budget as well.
+	//
+	// The budget is only set when this middleware creates the *Header, so
+	// it has no effect if an outer Middleware already created one.
+	Budget int
+
+	// EncodeOpts control how the metrics are encoded into the header
+	// value, such as rounding durations. The recorded metrics are not
+	// modified.
+	EncodeOpts
+
+	// SkipRunning leaves out metrics that are still running when the
+	// header is written, as reported by Metric.Running. Their duration is
+	// incomplete at that point, so sending it would be misleading. This
+	// matters when the header is written early, such as when the handler
+	// starts streaming the response while work is still in progress. The
+	// metrics in the request context are not modified, so they can still
+	// be reported later, such as with OnComplete.
+	SkipRunning bool
+
+	// ValidateBeforeWrite drops any metrics that fail Metric.Validate
+	// before the header is written. This prevents a single invalid metric
+	// from causing clients to reject the entire header. The metrics in the
+	// request context are not modified.
+	ValidateBeforeWrite bool
+
+	// ContextKey, if set, is an additional key the *Header is stored under
+	// in the request context. The *Header can then be retrieved with
+	// FromContextWithKey using the same key. It is always available with
+	// FromContext as well, so setting this never hides the *Header from
+	// code using the default key.
+	ContextKey interface{}
+
+	// CaptureBodyRead records the total time spent reading the request
+	// body as the "req-read" metric. The metric is only added if the
+	// body is read and only includes reads done before the header is
+	// written.
+	CaptureBodyRead bool
+
+	// CaptureBodyWrite records the total time spent writing the response
+	// body as the "resp-write" metric. Since the Server-Timing header is
+	// sent before the body, this metric is never part of the header
+	// itself. It is added to the *Header after the handler returns so
+	// that it is available to any outer handlers inspecting the metrics.
+	CaptureBodyWrite bool
+
+	// RecordOnPanic adds a "panic" metric and writes the header if the
+	// handler panics, before the panic continues up the stack. An outer
+	// handler that recovers from the panic and writes an error response
+	// will then send the timings collected up to the panic. The panic
+	// value is not included in the header since it may contain sensitive
+	// details. When nested, only the outermost Middleware writes the
+	// header, so this must be set on it for the header to be written.
+	//
+	// The metrics are also reported to LogWriter, Recent and OnComplete
+	// before the panic continues. There the "panic" metric has the panic
+	// value as its description, on a single line and truncated to 64
+	// characters.
+	RecordOnPanic bool
+
+	// CaptureRoute adds a "request" metric at the start of the header with
+	// the request method as the "method" param and, if RouteFunc is set,
+	// the matched route as the "route" param. This gives every response a
+	// consistent descriptor of what was requested.
+	CaptureRoute bool
+
+	// RouteFunc returns the route pattern that matched the request, such
+	// as "/users/{id}", for CaptureRoute. The standard library doesn't
+	// expose this so routers need to provide it. If this is nil or returns
+	// an empty string, the "route" param is not sent.
+	RouteFunc func(*http.Request) string
+
+	// CaptureHandlerName sets the description of the metric of
+	// CaptureRoute to the name of the handler passed to Middleware, such
+	// as "main.handleUsers". This shows which code handled a request
+	// without naming every handler manually. This has no effect unless
+	// CaptureRoute is set as well.
+	//
+	// The name is found with runtime.FuncForPC, so this only works if the
+	// handler is an http.HandlerFunc. For any other handler the name of
+	// its type is used, which is less useful for routers such as
+	// http.ServeMux. Function names reveal details of the code, so this
+	// is meant for development only.
+	CaptureHandlerName bool
+
+	// CaptureCold adds a "cold=true" param to the metric of CaptureRoute
+	// if the request was the first one on its connection. Such requests
+	// also paid for setting up the connection, such as the TCP and TLS
+	// handshakes, which can explain an otherwise unexpectedly slow
+	// response. This has no effect unless CaptureRoute is set as well.
+	//
+	// The net/http server doesn't expose whether a connection was reused,
+	// so this requires ConnContext to be set on the http.Server. Without
+	// it, no request is flagged. The detection is best-effort: with
+	// HTTP/2, only the first of the requests multiplexed on a new
+	// connection is flagged, even if others arrived at the same time, and
+	// behind a proxy or load balancer the connection is the one from the
+	// proxy rather than from the client.
+	CaptureCold bool
+
+	// CaptureStatus adds a "class" param to the metric of CaptureRoute
+	// with the class of the response status code, such as "2xx" or "5xx".
+	// This makes it easy to tell whether slow metrics correlate with error
+	// responses when scanning the headers of many requests. This has no
+	// effect unless CaptureRoute is set as well.
+	CaptureStatus bool
+
+	// DetectSharedHeader panics if a *Header created by a Middleware for
+	// one request ends up in the context of a different request, such as
+	// when a handler closure captures the *Header of an earlier request.
+	// Metrics from both requests would otherwise be mixed together
+	// silently. The check happens whenever a nested Middleware, or the
+	// Middleware of another request, finds an existing *Header in the
+	// context, so this must be enabled on the outermost Middleware to
+	// detect anything. This is meant for development and testing.
+	DetectSharedHeader bool
+
+	// CaptureETag adds an "etag" metric with the ETag response header as
+	// its description, if the handler set one before the header is
+	// written. This makes it easy to check cache keys in the browser
+	// developer tools.
+	CaptureETag bool
+
+	// LogWriter, if set, receives a one-line summary of the metrics of
+	// every request after the handler returns, such as:
+	//
+	//	GET /users sql=10.5ms cache=0.2ms
+	//
+	// This is a simple way to watch timings during development. Writes
+	// are serialized so the writer doesn't need to be safe for concurrent
+	// use. Requests without metrics are not logged.
+	LogWriter io.Writer
+
+	// OnComplete, if set, is called after the handler returns with the
+	// request and the *Header the metrics were recorded to. It is called
+	// whether or not the header was written, such as with DisableHeaders,
+	// so it can be used to report the metrics elsewhere. The *Header
+	// must not be retained after OnComplete returns. Use Header.Clone to
+	// keep a copy.
+	OnComplete func(*http.Request, *Header)
+
+	// Recent, if set, keeps a copy of the *Header of the most recent
+	// requests. See RecentHeaders.
+	Recent *RecentHeaders
+
+	// AllowOrigins, if non-empty, restricts sending the header on
+	// cross-origin requests to the listed origins, such as
+	// "https://example.com". If a request has an Origin header that isn't
+	// in this list, no timing headers are written. Requests without an
+	// Origin header are always allowed. The value "*" allows all origins.
+	//
+	// When the header is written for a request with an allowed origin,
+	// the Timing-Allow-Origin header is set to that origin so that
+	// cross-origin JavaScript can read the timings. "Vary: Origin" is
+	// always added so that shared caches keep the responses for different
+	// origins apart.
+	AllowOrigins []string
+
+	// TimingAllowOrigin, if set, is written as the Timing-Allow-Origin
+	// header whenever the Server-Timing header is written. Browsers don't
+	// expose Server-Timing to cross-origin JavaScript without it. This can
+	// be "*" or a specific origin. If AllowOrigins is also set, this value
+	// is used instead of the request origin.
+	TimingAllowOrigin string
+
+	// MirrorHeaders is a list of additional header keys that the
+	// Server-Timing value is also written to, such as "X-App-Timing". This
+	// is useful during migrations or for clients and proxies that strip
+	// or rename the standard header.
+	MirrorHeaders []string
+
+	// Base64Header, if set, is a header key that the metrics are also
+	// written to as base64 encoded JSON, such as "X-Timing-B64". This
+	// survives proxies and gateways that mangle the syntax of the
+	// Server-Timing value. Clients can decode it with DecodeB64Header.
+	// EncodeOpts don't apply so the durations are sent exactly.
+	Base64Header string
+
+	// LegendHeader, if set, is a header key such as
+	// "Server-Timing-Legend". The metric names in the Server-Timing header
+	// are then replaced with short names, such as "0" and "1", and this
+	// header is written with a JSON object that maps the short names to
+	// the original names. This keeps responses with many metrics with long
+	// names under header size limits. Clients that understand the legend
+	// can restore the names with Header.ApplyLegend, while the browser
+	// developer tools show the short names and descriptions.
+	LegendHeader string
+
+	// Version, if set, adds a synthetic metric named "version" with this
+	// value as its description to the end of the header. This lets tools
+	// that parse the header detect which version of an application's
+	// instrumentation produced it. The metric is only added when the
+	// header is written and is not visible in the request context.
+	Version string
+
+	// CaptureGoroutines adds a metric named "goroutines" with a "num"
+	// param containing the number of goroutines in the process when the
+	// header is written. This is a crude way to spot leaks or unexpected
+	// fan-out in the browser developer tools.
+	CaptureGoroutines bool
+
+	// CaptureAllocs adds a metric named "allocs" with the number of heap
+	// allocations as the "num" param and the allocated bytes as the
+	// "bytes" param, from the start of the request until the header is
+	// written. The counts are for the whole process, so they include the
+	// allocations of concurrent requests and are only meaningful when
+	// requests are sent one at a time, such as during development.
+	//
+	// This calls runtime.ReadMemStats twice per request, which stops the
+	// world each time. Don't enable it in production.
+	CaptureAllocs bool
+
 	// Maybe more in the future.
 }
 
@@ -19,80 +344,714 @@ type MiddlewareOpts struct {
 //
 // The options supplied to this can be nil to use defaults.
 //
+// If the request context already contains a *Header, such as when this
+// middleware is nested within another Middleware, that *Header is reused
+// so that all metrics end up in a single Server-Timing header. When
+// nested, only the outermost Middleware writes the header, so only its
+// options that control the header apply, such as DisableHeaders,
+// EmitNames and AllowOrigins. The options of inner ones that record
+// metrics or report them after the request, such as CaptureBodyRead and
+// OnComplete, still apply.
+//
 // The Server-Timing header will be written when the status is written
 // only if there are non-empty number of metrics.
 //
+// The position of the Server-Timing header among the response headers
+// can't be controlled. The net/http server writes the headers set on the
+// ResponseWriter sorted by key, regardless of when they were set, followed
+// by headers it adds itself such as Date and an implicit Content-Type.
+//
 // To control when Server-Timing is sent, the easiest approach is to wrap
 // this middleware and only call it if the request should send server timings.
 // For examples, see the README.
 func Middleware(next http.Handler, opts *MiddlewareOpts) http.Handler {
+	// Serializes writes to LogWriter
+	var logLock sync.Mutex
+
+	// The number of requests handled, for FirstN
+	var served int64
+
+	// The name of the handler, for CaptureHandlerName
+	var handlerName string
+	if opts != nil && opts.CaptureHandlerName {
+		handlerName = handlerFuncName(next)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var (
-			// Create the Server-Timing headers struct
-			h Header
-			// Remember if the timing header were added to the response headers
-			headerWritten bool
-		)
+		if opts != nil && opts.Enabled != nil && !opts.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// All of the per-request state is in a single allocation to keep
+		// the overhead of the middleware low. Get the header map. This is
+		// a reference and shouldn't change.
+		state := &middlewareState{
+			headers:     w.Header(),
+			opts:        opts,
+			handlerName: handlerName,
+			logLock:     &logLock,
+		}
+
+		// Reuse the Server-Timing headers struct if one is already in the
+		// context, such as from an outer Middleware. Otherwise use the one
+		// in our state and place it into the request context. This can be
+		// extracted again with FromContext.
+		state.h = FromContext(r.Context())
+		if state.h == nil {
+			state.h = &state.header
+			state.h.middleware = true
+			r = r.WithContext(NewContext(r.Context(), state.h))
 
-		// This places the *Header value into the request context. This
-		// can be extracted again with FromContext.
-		r = r.WithContext(NewContext(r.Context(), &h))
+			if opts != nil && (opts.Timeline || opts.Percent) {
+				state.h.startTime = now()
+			}
 
-		// Get the header map. This is a reference and shouldn't change.
-		headers := w.Header()
+			if opts != nil {
+				state.h.budget = opts.Budget
+				state.h.sequence = opts.Sequence
+			}
+
+			// Count every request, not only with CaptureCold, so the
+			// count stays right if handlers on the same server use
+			// different options.
+			state.h.cold = firstOnConn(r.Context())
+
+			if opts != nil && opts.DetectSharedHeader {
+				state.h.owner = state
+				r = r.WithContext(context.WithValue(r.Context(), ownerKey, state))
+			}
+		} else {
+			state.nested = state.h.middleware
+			if opts != nil && opts.DetectSharedHeader {
+				checkOwner(r, state.h)
+			}
+		}
+
+		// Check the origin up front since it decides whether the header
+		// is ever written. The response varies by origin whether or not
+		// it is allowed, so that shared caches don't serve the response
+		// of one origin to another.
+		if opts != nil && len(opts.AllowOrigins) > 0 && !state.nested {
+			state.headers.Add("Vary", "Origin")
+			state.disallowedOrigin = !opts.allowOrigin(r)
+		}
+		if opts != nil && opts.FirstN > 0 {
+			state.pastFirstN = atomic.AddInt64(&served, 1) > int64(opts.FirstN)
+		}
+
+		if opts != nil && opts.ContextKey != nil {
+			r = r.WithContext(NewContextWithKey(r.Context(), opts.ContextKey, state.h))
+		}
+
+		if opts != nil && opts.CaptureBodyRead && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &timedReadCloser{
+				ReadCloser: r.Body,
+				h:          state.h,
+				name:       bodyReadMetricName,
+			}
+		}
+
+		if opts != nil && opts.RecordOnPanic {
+			defer state.recordPanic()
+		}
+
+		state.r = r
+
+		if opts != nil && opts.CaptureAllocs {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			state.mallocs, state.allocBytes = ms.Mallocs, ms.TotalAlloc
+		}
 
 		// Hook the response writer we pass upstream so we can modify headers
 		// before they write them to the wire, but after we know what status
-		// they are writing.
-		hooks := httpsnoop.Hooks{
-			WriteHeader: func(original httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
-				// Return a function with same signature as
-				// http.ResponseWriter.WriteHeader to be called in it's place
-				return func(code int) {
-					// Write the headers and remember that headers were written
-					writeHeader(headers, &h, opts)
-					headerWritten = true
-
-					// Call the original WriteHeader function
-					original(code)
-				}
-			},
-
-			Write: func(original httpsnoop.WriteFunc) httpsnoop.WriteFunc {
-				return func(b []byte) (int, error) {
-					// If we didn't write headers, then we have to do that
-					// first before any data is written.
-					if !headerWritten {
-						writeHeader(headers, &h, opts)
-						headerWritten = true
-					}
-
-					return original(b)
-				}
-			},
-		}
-
-		w = httpsnoop.Wrap(w, hooks)
+		// they are writing. Wrapping is relatively expensive so it is
+		// skipped if the hooks would never do anything.
+		if state.needsHooks() {
+			w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: state.hookWriteHeader,
+				Write:       state.hookWrite,
+				ReadFrom:    state.hookReadFrom,
+			})
+		}
 		next.ServeHTTP(w, r)
 
 		// In case that next did not called WriteHeader function, add timing header to the response headers
-		if !headerWritten {
-			writeHeader(headers, &h, opts)
+		if !state.headerWritten {
+			state.writeHeader()
+		}
+
+		if opts != nil && opts.CaptureBodyWrite && state.wrote {
+			state.h.Add(&Metric{
+				Name:     bodyWriteMetricName,
+				Duration: state.writeDuration,
+			})
 		}
+
+		state.complete(state.h)
 	})
 }
 
-func writeHeader(headers http.Header, h *Header, opts *MiddlewareOpts) {
+// middlewareState is the state for a single request handled by Middleware.
+type middlewareState struct {
+	// h is the *Header metrics are recorded to. This points to header
+	// unless a *Header was already in the request context.
+	h      *Header
+	header Header
+
+	headers http.Header
+	opts    *MiddlewareOpts
+
+	// r is the request being handled, after the *Header was added to
+	// its context.
+	r *http.Request
+
+	// handlerName is the name of the wrapped handler if
+	// MiddlewareOpts.CaptureHandlerName is set.
+	handlerName string
+
+	// logLock serializes writes to MiddlewareOpts.LogWriter. It is shared
+	// by all requests handled by the Middleware.
+	logLock *sync.Mutex
+
+	// nested is true if the *Header was created by an outer Middleware,
+	// which then writes it instead of this one.
+	nested bool
+
+	// disallowedOrigin is true if the request origin is not allowed by
+	// MiddlewareOpts.AllowOrigins.
+	disallowedOrigin bool
+
+	// pastFirstN is true if MiddlewareOpts.FirstN requests were already
+	// handled before this one.
+	pastFirstN bool
+
+	// Remember if the timing header were added to the response headers
+	headerWritten bool
+
+	// status is the status code passed to WriteHeader, or zero if it
+	// wasn't called.
+	status int
+
+	// The total time spent writing the response body, only recorded if
+	// MiddlewareOpts.CaptureBodyWrite is set.
+	writeDuration time.Duration
+	wrote         bool
+
+	// The allocation counters at the start of the request, only recorded
+	// if MiddlewareOpts.CaptureAllocs is set.
+	mallocs    uint64
+	allocBytes uint64
+}
+
+// complete reports the metrics in h once the request is done, such as
+// to MiddlewareOpts.OnComplete.
+func (s *middlewareState) complete(h *Header) {
+	opts, r := s.opts, s.r
+	if opts == nil {
+		return
+	}
+
+	if opts.LogWriter != nil {
+		if line := logLine(r, h, opts.encodeOpts()); line != "" {
+			s.logLock.Lock()
+			io.WriteString(opts.LogWriter, line)
+			s.logLock.Unlock()
+		}
+	}
+
+	if opts.Recent != nil {
+		opts.Recent.add(r, h)
+	}
+
+	if opts.OnComplete != nil {
+		opts.OnComplete(r, h)
+	}
+}
+
+// recordPanic must be deferred. If the handler panicked, it records the
+// panic metric, writes the header and reports the metrics before
+// re-panicking.
+func (s *middlewareState) recordPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	// The reported metrics describe the panic, but the header doesn't
+	// since it is public.
+	reported := s.h.Clone()
+	reported.Metrics = append(reported.Metrics, &Metric{
+		Name: panicMetricName,
+		Desc: panicDesc(v),
+	})
+
+	s.h.Add(&Metric{Name: panicMetricName})
+	if !s.headerWritten {
+		// A recovering handler further up usually responds with a 500
+		s.status = http.StatusInternalServerError
+		s.writeHeader()
+		s.headerWritten = true
+	}
+
+	s.complete(reported)
+	panic(v)
+}
+
+// panicDescMax is the maximum number of characters of the panic value that
+// are reported by recordPanic.
+const panicDescMax = 64
+
+// panicDesc returns the panic value v as a single line of at most
+// panicDescMax characters.
+func panicDesc(v interface{}) string {
+	desc := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+
+		return r
+	}, fmt.Sprint(v))
+
+	if runes := []rune(desc); len(runes) > panicDescMax {
+		desc = string(runes[:panicDescMax]) + "..."
+	}
+
+	return desc
+}
+
+// needsHooks returns true if the ResponseWriter must be wrapped. This is
+// the case unless the header is known to never be written up front and
+// writes aren't timed. DisableForRequest can't be known up front, so it
+// doesn't avoid wrapping.
+func (s *middlewareState) needsHooks() bool {
+	if s.opts == nil {
+		return true
+	}
+
+	return !s.headerDisabled() || s.opts.CaptureBodyWrite
+}
+
+// headerDisabled returns true if the options or the request already rule
+// out writing the header before the handler is called.
+func (s *middlewareState) headerDisabled() bool {
+	return s.nested || (s.opts != nil && s.opts.DisableHeaders) || s.disallowedOrigin || s.pastFirstN
+}
+
+func (s *middlewareState) hookWriteHeader(original httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+	// Return a function with same signature as
+	// http.ResponseWriter.WriteHeader to be called in it's place
+	return func(code int) {
+		// Write the headers and remember that headers were written
+		s.status = code
+		s.writeHeader()
+		s.headerWritten = true
+
+		// Call the original WriteHeader function
+		original(code)
+	}
+}
+
+func (s *middlewareState) hookWrite(original httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+	return func(b []byte) (int, error) {
+		// If we didn't write headers, then we have to do that
+		// first before any data is written.
+		if !s.headerWritten {
+			s.writeHeader()
+			s.headerWritten = true
+		}
+
+		if s.opts == nil || !s.opts.CaptureBodyWrite {
+			return original(b)
+		}
+
+		start := now()
+		n, err := original(b)
+		s.writeDuration += now().Sub(start)
+		s.wrote = true
+		return n, err
+	}
+}
+
+// hookReadFrom is the same as hookWrite for io.ReaderFrom, which is used
+// by io.Copy instead of Write when the ResponseWriter implements it.
+func (s *middlewareState) hookReadFrom(original httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+	return func(src io.Reader) (int64, error) {
+		if !s.headerWritten {
+			s.writeHeader()
+			s.headerWritten = true
+		}
+
+		if s.opts == nil || !s.opts.CaptureBodyWrite {
+			return original(src)
+		}
+
+		start := now()
+		n, err := original(src)
+		s.writeDuration += now().Sub(start)
+		s.wrote = true
+		return n, err
+	}
+}
+
+// MiddlewareFunc returns a function that wraps an http.Handler with
+// Middleware using the given options. This matches the
+// func(http.Handler) http.Handler shape that most routers such as chi,
+// gorilla/mux, and negroni expect for middleware:
+//
+//	r.Use(servertiming.MiddlewareFunc(nil))
+func MiddlewareFunc(opts *MiddlewareOpts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Middleware(next, opts)
+	}
+}
+
+// TimingAllowOriginKey is the header key used to allow cross-origin
+// access to the timing information.
+const TimingAllowOriginKey = "Timing-Allow-Origin"
+
+// allowOrigin checks the request origin against AllowOrigins.
+func (opts *MiddlewareOpts) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range opts.AllowOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ownerKeyType is the context key for the middleware state that owns the
+// *Header in the context, used for MiddlewareOpts.DetectSharedHeader.
+type ownerKeyType struct{}
+
+var ownerKey = ownerKeyType(struct{}{})
+
+// checkOwner panics if h is owned by a request other than r.
+func checkOwner(r *http.Request, h *Header) {
+	h.Lock()
+	owner := h.owner
+	h.Unlock()
+
+	if owner != nil && r.Context().Value(ownerKey) != owner {
+		panic(fmt.Sprintf(
+			"servertiming: *Header of another request found in the context of request %s %s",
+			r.Method, r.URL.Path))
+	}
+}
+
+// logLine returns the line written to MiddlewareOpts.LogWriter for the
+// request, or an empty string if there are no metrics.
+func logLine(r *http.Request, h *Header, encodeOpts *EncodeOpts) string {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.Metrics) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.Path)
+	for _, m := range h.Metrics {
+		b.WriteByte(' ')
+		b.WriteString(m.Name)
+		b.WriteByte('=')
+		b.WriteString(encodeOpts.formatDuration(m.Duration))
+		b.WriteString("ms")
+	}
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+// routeMetricName is the name of the metric added for
+// MiddlewareOpts.CaptureRoute.
+const routeMetricName = "request"
+
+// etagMetricName is the name of the metric added for
+// MiddlewareOpts.CaptureETag.
+const etagMetricName = "etag"
+
+// panicMetricName is the name of the metric added for
+// MiddlewareOpts.RecordOnPanic.
+const panicMetricName = "panic"
+
+// versionMetricName is the name of the synthetic metric added for
+// MiddlewareOpts.Version.
+const versionMetricName = "version"
+
+// Names of the metrics added for MiddlewareOpts.CaptureGoroutines and
+// MiddlewareOpts.CaptureAllocs.
+const (
+	goroutinesMetricName = "goroutines"
+	allocsMetricName     = "allocs"
+)
+
+func (s *middlewareState) writeHeader() {
+	h, headers, opts := s.h, s.headers, s.opts
+
+	// Wait for the metrics of goroutines started with Go, which are
+	// stopped right after the handler saw them finish.
+	if !s.headerDisabled() {
+		h.pending.Wait()
+	}
+
 	// Grab the lock just in case there is any ongoing concurrency that
 	// still has a reference and may be modifying the value.
 	h.Lock()
-	defer h.Unlock()
 
-	// If there are no metrics set, or if the user opted-out writing headers,
-	// do nothing
-	if (opts != nil && opts.DisableHeaders) || len(h.Metrics) == 0 {
+	// If there are no metrics set, or if the user opted-out writing headers
+	// for all requests or this request, do nothing
+	if s.headerDisabled() || h.disabled || len(h.Metrics) == 0 {
+		h.Unlock()
+		return
+	}
+
+	// Without options the metrics are written as is
+	if opts == nil {
+		value := h.String()
+		h.Unlock()
+		headers.Set(HeaderKey, value)
 		return
 	}
 
-	headers.Set(HeaderKey, h.String())
+	// The options are applied to a copy without holding the lock since
+	// they call user functions, such as NameNormalizer, that may use the
+	// *Header themselves.
+	snapshot := h.clone()
+	h.Unlock()
+
+	encodeOpts := opts.encodeOpts()
+	out := s.transform(snapshot, encodeOpts)
+	if len(out.Metrics) == 0 {
+		return
+	}
+
+	value := out.StringOpts(encodeOpts)
+	if opts != nil && opts.LegendHeader != "" {
+		short := out.clone()
+		legend, err := json.Marshal(shortenNames(short.Metrics))
+		if err == nil {
+			value = short.StringOpts(encodeOpts)
+			headers.Set(opts.LegendHeader, string(legend))
+		}
+	}
+
+	headers.Set(HeaderKey, value)
+	for _, k := range opts.MirrorHeaders {
+		headers.Set(k, value)
+	}
+
+	if opts.Base64Header != "" {
+		if b64, err := encodeB64(out.Metrics); err == nil {
+			headers.Set(opts.Base64Header, b64)
+		}
+	}
+
+	if opts.TimingAllowOrigin != "" {
+		headers.Set(TimingAllowOriginKey, opts.TimingAllowOrigin)
+	} else if origin := s.r.Header.Get("Origin"); len(opts.AllowOrigins) > 0 && origin != "" {
+		headers.Set(TimingAllowOriginKey, origin)
+	}
+}
+
+// encodeOpts returns the EncodeOpts to use when writing the header. This
+// may be nil.
+func (opts *MiddlewareOpts) encodeOpts() *EncodeOpts {
+	if opts == nil {
+		return nil
+	}
+
+	result := &opts.EncodeOpts
+	if opts.Deterministic && !result.SortExtra {
+		copyOpts := *result
+		copyOpts.SortExtra = true
+		result = &copyOpts
+	}
+
+	return result
+}
+
+// transform applies the options that modify the metrics before they are
+// written, such as Dedup. out must be a copy of the recorded *Header,
+// which is modified and returned, so the metrics in the request context
+// remain as they were recorded. The lock on the recorded *Header must not
+// be held.
+func (s *middlewareState) transform(out *Header, encodeOpts *EncodeOpts) *Header {
+	r, opts := s.r, s.opts
+	if opts.CaptureRoute {
+		m := &Metric{Name: routeMetricName}
+		m.WithExtra(paramNameMethod, r.Method)
+		if opts.RouteFunc != nil {
+			if route := opts.RouteFunc(r); route != "" {
+				m.WithExtra(paramNameRoute, route)
+			}
+		}
+		if opts.CaptureHandlerName {
+			m.Desc = s.handlerName
+		}
+		if opts.CaptureCold && s.h.cold {
+			m.WithExtra(paramNameCold, "true")
+		}
+		if opts.CaptureStatus {
+			// Responses without an explicit status are implicitly a 200
+			status := s.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			m.WithExtra(paramNameClass, strconv.Itoa(status/100)+"xx")
+		}
+
+		out.Metrics = append([]*Metric{m}, out.Metrics...)
+	}
+
+	if opts.SkipRunning {
+		done := out.Metrics[:0]
+		for _, m := range out.Metrics {
+			if !m.Running() {
+				done = append(done, m)
+			}
+		}
+
+		out.Metrics = done
+		if len(out.Metrics) == 0 {
+			return out
+		}
+	}
+
+	if opts.NameNormalizer != nil {
+		for _, m := range out.Metrics {
+			m.Name = opts.NameNormalizer(m.Name)
+		}
+	}
+
+	if opts.Dedup {
+		out.DedupMerge(opts.DedupMerge)
+	}
+
+	if opts.Deterministic {
+		out.Sort(func(a, b *Metric) bool {
+			return a.Name < b.Name
+		})
+	}
+
+	if opts.SortByStop {
+		out.Sort(func(a, b *Metric) bool {
+			return a.stopTime.After(b.stopTime)
+		})
+	}
+
+	if opts.Timeline && !out.startTime.IsZero() {
+		for _, m := range out.Metrics {
+			if !m.startTime.IsZero() {
+				m.WithExtra(paramNameStart, encodeOpts.formatDuration(m.startTime.Sub(out.startTime)))
+			}
+		}
+	}
+
+	if opts.Percent && !out.startTime.IsZero() {
+		total := now().Sub(out.startTime)
+		for _, m := range out.Metrics {
+			if m.Measured() && total > 0 {
+				pct := float64(m.Duration) / float64(total) * 100
+				m.WithExtra(paramNamePct, strconv.FormatFloat(pct, 'f', 1, 64))
+			}
+		}
+	}
+
+	if opts.Sequence {
+		for _, m := range out.Metrics {
+			if m.seq > 0 {
+				m.WithExtra(paramNameSeq, strconv.Itoa(m.seq))
+			}
+		}
+	}
+
+	if opts.ValidateBeforeWrite {
+		valid := make([]*Metric, 0, len(out.Metrics))
+		for _, m := range out.Metrics {
+			if m.Validate() == nil {
+				valid = append(valid, m)
+			}
+		}
+
+		out.Metrics = valid
+		if len(out.Metrics) == 0 {
+			return out
+		}
+	}
+
+	if etag := s.headers.Get("ETag"); opts.CaptureETag && etag != "" {
+		out.Metrics = append(out.Metrics, &Metric{
+			Name: etagMetricName,
+			Desc: etag,
+		})
+	}
+
+	if opts.Version != "" {
+		out.Metrics = append(out.Metrics, &Metric{
+			Name: versionMetricName,
+			Desc: opts.Version,
+		})
+	}
+
+	if opts.CaptureGoroutines {
+		m := &Metric{Name: goroutinesMetricName}
+		m.WithExtra(paramNameNum, strconv.Itoa(runtime.NumGoroutine()))
+		out.Metrics = append(out.Metrics, m)
+	}
+
+	if opts.CaptureAllocs {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		m := &Metric{Name: allocsMetricName}
+		m.WithExtra(paramNameNum, strconv.FormatUint(ms.Mallocs-s.mallocs, 10))
+		m.WithExtra(paramNameBytes, strconv.FormatUint(ms.TotalAlloc-s.allocBytes, 10))
+		out.Metrics = append(out.Metrics, m)
+	}
+
+	if len(opts.EmitNames) > 0 {
+		emit := make([]*Metric, 0, len(out.Metrics))
+		for _, m := range out.Metrics {
+			if containsString(opts.EmitNames, m.Name) {
+				emit = append(emit, m)
+			}
+		}
+
+		out.Metrics = emit
+	}
+
+	return out
+}
+
+// handlerFuncName returns the name of the function of h if it is an
+// http.HandlerFunc, or the name of its type otherwise.
+func handlerFuncName(h http.Handler) string {
+	if f, ok := h.(http.HandlerFunc); ok {
+		if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+
+	return fmt.Sprintf("%T", h)
+}
+
+// containsString returns true if v is in list.
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,8 +1,18 @@
 package servertiming
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -130,6 +140,96 @@ func TestMiddleware(t *testing.T) {
 	}
 }
 
+func TestMiddleware_disableHeadersCollects(t *testing.T) {
+	// Pass in our own header so the metrics can be inspected after the
+	// request, as a logger or tracer would.
+	var h Header
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(NewContext(r.Context(), &h))
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := FromContext(r.Context())
+		if timing == nil {
+			t.Fatal("expected *Header to be present in context")
+		}
+
+		timing.NewMetric("sql").Start().Stop()
+		timing.AddDuration("cache", 5*time.Millisecond)
+		w.WriteHeader(responseStatus)
+		w.Write([]byte(responseBody))
+	})
+
+	Middleware(handler, &MiddlewareOpts{DisableHeaders: true}).ServeHTTP(rec, r)
+
+	if _, ok := rec.Header()[HeaderKey]; ok {
+		t.Fatalf("expected no header, got: %q", rec.Header().Get(HeaderKey))
+	}
+
+	if len(h.Metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got: %#v", h.Metrics)
+	}
+	if m := h.Metrics[0]; m.Name != "sql" || !m.Measured() {
+		t.Fatalf("bad: %#v", m)
+	}
+	if m := h.Metrics[1]; m.Name != "cache" || m.Duration != 5*time.Millisecond {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// The collected metrics can still be encoded as usual
+	if actual := h.String(); !strings.HasSuffix(actual, ",cache;dur=5") {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestMiddleware_disableForRequest(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Disable  bool
+		Expected string
+	}{
+		{
+			"disabled",
+			true,
+			"",
+		},
+
+		{
+			"enabled",
+			false,
+			"sql;dur=10",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			var h *Header
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h = FromContext(r.Context())
+				h.NewMetric("sql").Duration = 10 * time.Millisecond
+				if tt.Disable {
+					DisableForRequest(r.Context())
+				}
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(handler, nil).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+
+			// The metrics are still recorded
+			if len(h.Metrics) != 1 {
+				t.Fatalf("bad: %#v", h.Metrics)
+			}
+		})
+	}
+}
+
 // We need to test this separately since the httptest.ResponseRecorder
 // doesn't properly reflect that headers can't be set after writing data,
 // so we have to use a real server.
@@ -175,3 +275,2010 @@ func TestMiddleware_writeHeaderNotCalled(t *testing.T) {
 		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
 	}
 }
+
+func TestMiddleware_dedup(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var recorded []*Metric
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+		h.NewMetric("sql").Duration = 20 * time.Millisecond
+		recorded = h.Metrics
+		w.Write([]byte(responseBody))
+	})
+
+	Middleware(handler, &MiddlewareOpts{Dedup: true}).ServeHTTP(rec, r)
+
+	expected := "sql;dur=30;count=2"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+
+	// The recorded metrics should be left untouched
+	if len(recorded) != 2 || recorded[0].Duration != 10*time.Millisecond {
+		t.Fatalf("recorded metrics were modified: %#v", recorded)
+	}
+}
+
+func TestMiddleware_dedupMerge(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var recorded []*Metric
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("cache").WithExtra("hit", "")
+		h.NewMetric("cache").WithExtra("miss", "")
+		recorded = h.Metrics
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{
+		Dedup: true,
+		DedupMerge: func(dst, src map[string]string) {
+			for k, v := range src {
+				dst[k] = v
+			}
+		},
+		EncodeOpts: EncodeOpts{SortExtra: true},
+	}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "cache;count=2;hit;miss"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+
+	// The recorded metrics should be left untouched
+	if len(recorded) != 2 || len(recorded[0].Extra) != 1 {
+		t.Fatalf("recorded metrics were modified: %#v", recorded)
+	}
+}
+
+// TestMiddleware_callbacksUseHeader verifies that the functions in the
+// options can use the *Header of the request without deadlocking.
+func TestMiddleware_callbacksUseHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var h *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+		h.NewMetric("sql").Duration = 20 * time.Millisecond
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{
+		NameNormalizer: func(name string) string {
+			_ = h.String()
+			return name
+		},
+		Dedup: true,
+		DedupMerge: func(dst, src map[string]string) {
+			_ = h.String()
+		},
+		CaptureRoute: true,
+		RouteFunc: func(r *http.Request) string {
+			FromContext(r.Context()).Add(&Metric{Name: "route"})
+			return "/"
+		},
+		EncodeOpts: EncodeOpts{SortExtra: true},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Middleware(handler, opts).ServeHTTP(rec, r)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+
+	expected := `request;method=GET;route="/",sql;dur=30;count=2`
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_nameNormalizer(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     *MiddlewareOpts
+		Expected string
+	}{
+		{
+			"normalize",
+			&MiddlewareOpts{NameNormalizer: strings.ToLower},
+			"sql-1;dur=10,sql-1;dur=20",
+		},
+
+		{
+			"normalize with dedup",
+			&MiddlewareOpts{NameNormalizer: strings.ToLower, Dedup: true},
+			"sql-1;dur=30;count=2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			var recorded []*Metric
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := FromContext(r.Context())
+				h.NewMetric("SQL-1").Duration = 10 * time.Millisecond
+				h.NewMetric("sql-1").Duration = 20 * time.Millisecond
+				recorded = h.Metrics
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(handler, tt.Opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+
+			// The recorded metrics should be left untouched
+			if recorded[0].Name != "SQL-1" {
+				t.Fatalf("recorded metrics were modified: %#v", recorded)
+			}
+		})
+	}
+}
+
+func TestMiddleware_emitNames(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     *MiddlewareOpts
+		Expected string
+	}{
+		{
+			"all",
+			&MiddlewareOpts{},
+			"sql;dur=10,cache;dur=20,internal;dur=30",
+		},
+
+		{
+			"allowlist",
+			&MiddlewareOpts{EmitNames: []string{"cache", "sql"}},
+			"sql;dur=10,cache;dur=20",
+		},
+
+		{
+			"none allowed",
+			&MiddlewareOpts{EmitNames: []string{"other"}},
+			"",
+		},
+
+		{
+			"version",
+			&MiddlewareOpts{EmitNames: []string{"sql", versionMetricName}, Version: "2"},
+			"sql;dur=10,version;desc=2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			var recorded []*Metric
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := FromContext(r.Context())
+				h.NewMetric("sql").Duration = 10 * time.Millisecond
+				h.NewMetric("cache").Duration = 20 * time.Millisecond
+				h.NewMetric("internal").Duration = 30 * time.Millisecond
+				recorded = h.Metrics
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(handler, tt.Opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+
+			// The recorded metrics should be left untouched
+			if len(recorded) != 3 {
+				t.Fatalf("recorded metrics were modified: %#v", recorded)
+			}
+		})
+	}
+}
+
+func TestMiddleware_enabled(t *testing.T) {
+	enabled := false
+	opts := &MiddlewareOpts{Enabled: func() bool { return enabled }}
+
+	var h *Header
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+		w.Write([]byte(responseBody))
+	}), opts)
+
+	// Disabled
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if h != nil {
+		t.Fatal("expected no *Header in context")
+	}
+	if actual := rec.Header().Get(HeaderKey); actual != "" {
+		t.Fatalf("expected no header, got: %q", actual)
+	}
+	if responseBody != rec.Body.String() {
+		t.Fatalf("got unexpected body, expected != actual: %q != %q", responseBody, rec.Body.String())
+	}
+
+	// Enabled at runtime
+	enabled = true
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if actual := rec.Header().Get(HeaderKey); actual != "sql;dur=10" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+// TestMiddleware_headerOrder documents where the header is placed on the
+// wire. Go's header map is unordered and the server sorts the keys set by
+// the handler when writing, so the order in which they're set doesn't
+// matter. Headers the server adds itself, like Date, follow.
+func TestMiddleware_headerOrder(t *testing.T) {
+	ts := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+		w.Header().Set("X-Custom", "1")
+		w.Header().Set("Accept-Ranges", "none")
+		w.Write([]byte(responseBody))
+	}), nil))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	raw, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(raw), "\r\n")[1:] {
+		if line == "" {
+			break
+		}
+		keys = append(keys, line[:strings.IndexByte(line, ':')])
+	}
+
+	expected := []string{"Accept-Ranges", HeaderKey, "X-Custom"}
+	if len(keys) < len(expected) || !reflect.DeepEqual(keys[:len(expected)], expected) {
+		t.Fatalf("received, expected:\n\n%v\n\n%v", keys, expected)
+	}
+}
+
+// TestMiddleware_writeOnce verifies that the header ends up in the
+// response exactly once and that the middleware never causes a superfluous
+// WriteHeader call, however the handler writes its response.
+func TestMiddleware_writeOnce(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Handler func(http.ResponseWriter)
+		Nested  bool
+	}{
+		{
+			"write header",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(responseStatus)
+			},
+			false,
+		},
+
+		{
+			"write header and body",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(responseStatus)
+				w.Write([]byte(responseBody))
+			},
+			false,
+		},
+
+		{
+			"body only",
+			func(w http.ResponseWriter) {
+				w.Write([]byte(responseBody))
+			},
+			false,
+		},
+
+		{
+			"nothing",
+			func(w http.ResponseWriter) {},
+			false,
+		},
+
+		{
+			"nested",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(responseStatus)
+				w.Write([]byte(responseBody))
+			},
+			true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+				tt.Handler(w)
+			})
+			// Only the outermost Middleware writes the header
+			opts := &MiddlewareOpts{MirrorHeaders: []string{"X-Timing"}}
+			if tt.Nested {
+				handler = Middleware(handler, nil)
+			}
+			handler = Middleware(handler, opts)
+
+			var logs bytes.Buffer
+			ts := httptest.NewUnstartedServer(handler)
+			ts.Config.ErrorLog = log.New(&logs, "", 0)
+			ts.Start()
+			defer ts.Close()
+
+			res, err := http.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			for _, k := range []string{HeaderKey, "X-Timing"} {
+				if values := res.Header[k]; len(values) != 1 || values[0] != "sql;dur=10" {
+					t.Fatalf("expected exactly one %s value, got: %q", k, values)
+				}
+			}
+
+			ts.Close()
+			if logs.Len() > 0 {
+				t.Fatalf("unexpected server logs: %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestMiddleware_sequence(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var recorded []*Metric
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+		h.AddDuration("cache", 5*time.Millisecond)
+		h.AppendFromString("db;dur=1")
+		recorded = h.Metrics
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{Sequence: true, Deterministic: true}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "cache;dur=5;seq=2,db;dur=1;seq=3,sql;dur=10;seq=1"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+
+	// The recorded metrics should be left untouched
+	for _, m := range recorded {
+		if _, ok := m.Extra[paramNameSeq]; ok {
+			t.Fatalf("recorded metrics were modified: %#v", m)
+		}
+	}
+}
+
+func TestMiddleware_budget(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var h *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+		for i := 0; i < 5; i++ {
+			h.NewMetric(fmt.Sprintf("sql-%d", i)).Start().Stop().Duration = 10 * time.Millisecond
+		}
+		h.AddDuration("cache", 5*time.Millisecond)
+		h.AppendFromString("db;dur=1")
+		w.Write([]byte(responseBody))
+	})
+
+	Middleware(handler, &MiddlewareOpts{Budget: 3}).ServeHTTP(rec, r)
+
+	expected := "sql-0;dur=10,sql-1;dur=10,sql-2;dur=10"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if len(h.Metrics) != 3 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+}
+
+func TestMiddleware_budgetBodyRead(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("request"))
+	rec := httptest.NewRecorder()
+
+	var h *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{Budget: 1, Sequence: true, CaptureBodyRead: true}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	// The body read metric counts towards the budget like any other
+	expected := "sql;dur=10;seq=1"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if len(h.Metrics) != 1 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+}
+
+func TestMiddleware_percent(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		m := h.NewMetric("sql").Start()
+		time.Sleep(20 * time.Millisecond)
+		m.Stop()
+		h.NewMetric("region").WithDesc("us")
+		w.Write([]byte(responseBody))
+	})
+
+	Middleware(handler, &MiddlewareOpts{Percent: true}).ServeHTTP(rec, r)
+
+	h, err := ParseHeader(rec.Header().Get(HeaderKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Metrics) != 2 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+
+	// The sleep is nearly all of the request
+	raw := h.Metrics[0].Extra[paramNamePct]
+	if pct, ok := h.Metrics[0].ExtraFloat(paramNamePct); !ok || pct < 50 || pct > 100 {
+		t.Fatalf("bad pct: %q", raw)
+	}
+	if i := strings.IndexByte(raw, '.'); i < 0 || len(raw)-i != 2 {
+		t.Fatalf("expected one decimal: %q", raw)
+	}
+
+	// Metrics without a duration have no percentage
+	if _, ok := h.Metrics[1].Extra[paramNamePct]; ok {
+		t.Fatalf("bad: %#v", h.Metrics[1])
+	}
+}
+
+func TestMiddleware_firstN(t *testing.T) {
+	var logs bytes.Buffer
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+		w.Write([]byte(responseBody))
+	}), &MiddlewareOpts{FirstN: 2, LogWriter: &logs})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		expected := ""
+		if i < 2 {
+			expected = "sql;dur=10"
+		}
+		if actual := rec.Header().Get(HeaderKey); actual != expected {
+			t.Fatalf("request %d: got wrong value, expected != actual: %q != %q", i, expected, actual)
+		}
+	}
+
+	// Metrics are still gathered after the first N requests
+	if n := strings.Count(logs.String(), "sql=10ms"); n != 4 {
+		t.Fatalf("expected 4 log lines, got: %q", logs.String())
+	}
+}
+
+func TestMiddleware_onComplete(t *testing.T) {
+	var calls int
+	var completed *Header
+	opts := &MiddlewareOpts{
+		DisableHeaders: true,
+		OnComplete: func(r *http.Request, h *Header) {
+			calls++
+			if r.URL.Path != "/users" {
+				t.Fatalf("bad request: %#v", r)
+			}
+			completed = h
+		},
+	}
+
+	var recorded *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded = FromContext(r.Context())
+		recorded.NewMetric("sql").Duration = 10 * time.Millisecond
+		w.Write([]byte(responseBody))
+	})
+
+	rec := httptest.NewRecorder()
+	Middleware(handler, opts).ServeHTTP(rec, httptest.NewRequest("GET", "/users", nil))
+
+	if calls != 1 || completed != recorded {
+		t.Fatalf("expected one call with the recorded header: %d", calls)
+	}
+	if len(completed.Metrics) != 1 {
+		t.Fatalf("bad: %#v", completed.Metrics)
+	}
+}
+
+func TestMiddleware_noWrite(t *testing.T) {
+	metrics := []*Metric{
+		{
+			Name:     "sql-1",
+			Duration: 100 * time.Millisecond,
+			Desc:     "MySQL; lookup Server",
+		},
+	}
+
+	// Start our test server with a handler that writes nothing at all
+	ts := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Metrics = metrics
+	}), nil))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected implicit 200, got: %d", res.StatusCode)
+	}
+
+	expected := (&Header{Metrics: metrics}).String()
+	actual := res.Header.Get(HeaderKey)
+	if actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_encodeOpts(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var m *Metric
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m = FromContext(r.Context()).NewMetric("sql")
+		m.Duration = 1263 * time.Microsecond
+	})
+
+	opts := &MiddlewareOpts{EncodeOpts: EncodeOpts{Digits: 1}}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "sql;dur=1.3"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if m.Duration != 1263*time.Microsecond {
+		t.Fatalf("duration was modified: %s", m.Duration)
+	}
+}
+
+func TestMiddleware_nested(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var outer, inner *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner = FromContext(r.Context())
+		inner.NewMetric("inner").Duration = 10 * time.Millisecond
+		w.WriteHeader(responseStatus)
+	})
+
+	// The outer middleware records a metric around the inner middleware
+	var h http.Handler = Middleware(handler, nil)
+	h = http.HandlerFunc(func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			outer = FromContext(r.Context())
+			outer.NewMetric("outer").Duration = 20 * time.Millisecond
+			next.ServeHTTP(w, r)
+		}
+	}(h))
+	Middleware(h, nil).ServeHTTP(rec, r)
+
+	if outer != inner {
+		t.Fatal("nested middleware should share the *Header")
+	}
+
+	values := rec.Header()[HeaderKey]
+	expected := []string{"outer;dur=20,inner;dur=10"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, values)
+	}
+}
+
+func TestMiddleware_nestedOuterOpts(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Opts     *MiddlewareOpts
+		Expected string
+	}{
+		{
+			"disabled",
+			&MiddlewareOpts{DisableHeaders: true},
+			"",
+		},
+
+		{
+			"disallowed origin",
+			&MiddlewareOpts{AllowOrigins: []string{"https://example.com"}},
+			"",
+		},
+
+		{
+			"emit names",
+			&MiddlewareOpts{EmitNames: []string{"cache"}},
+			"cache;dur=2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Origin", "https://evil.com")
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := FromContext(r.Context())
+				h.NewMetric("sql").Duration = 1 * time.Millisecond
+				h.NewMetric("cache").Duration = 2 * time.Millisecond
+				w.WriteHeader(responseStatus)
+			})
+
+			// The inner middleware would send everything on its own
+			inner := Middleware(handler, &MiddlewareOpts{
+				MirrorHeaders:     []string{"X-Timing"},
+				TimingAllowOrigin: "*",
+			})
+			Middleware(inner, tt.Opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+			for _, k := range []string{"X-Timing", TimingAllowOriginKey} {
+				if v := rec.Header().Get(k); v != "" {
+					t.Fatalf("unexpected %s header: %q", k, v)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_version(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Metrics  bool
+		Expected string
+	}{
+		{
+			"with metrics",
+			true,
+			`sql;dur=10,version;desc=2`,
+		},
+
+		{
+			"without metrics",
+			false,
+			"",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			var h *Header
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h = FromContext(r.Context())
+				if tt.Metrics {
+					h.NewMetric("sql").Duration = 10 * time.Millisecond
+				}
+			})
+
+			Middleware(handler, &MiddlewareOpts{Version: "2"}).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+
+			// The synthetic metric should not be recorded
+			for _, m := range h.Metrics {
+				if m.Name == versionMetricName {
+					t.Fatal("version metric should not be in the recorded metrics")
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_validateBeforeWrite(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Metrics  []*Metric
+		Expected string
+	}{
+		{
+			"drops invalid metrics",
+			[]*Metric{
+				{Name: "bad name", Duration: 10 * time.Millisecond},
+				{Name: "sql", Duration: 10 * time.Millisecond},
+			},
+			"sql;dur=10",
+		},
+
+		{
+			"all invalid",
+			[]*Metric{
+				{Name: "bad name", Duration: 10 * time.Millisecond},
+			},
+			"",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).Metrics = tt.Metrics
+			})
+
+			Middleware(handler, &MiddlewareOpts{ValidateBeforeWrite: true}).ServeHTTP(rec, r)
+
+			_, present := map[string][]string(rec.Header())[HeaderKey]
+			if present != (tt.Expected != "") {
+				t.Fatalf("expected header to be present: %v", tt.Expected != "")
+			}
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddlewareFunc(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+	})
+
+	MiddlewareFunc(nil)(handler).ServeHTTP(rec, r)
+
+	expected := "sql;dur=10"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_mirrorHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+	})
+
+	opts := &MiddlewareOpts{MirrorHeaders: []string{"X-Timing", "X-Other-Timing"}}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "sql;dur=10"
+	for _, k := range []string{HeaderKey, "X-Timing", "X-Other-Timing"} {
+		if actual := rec.Header().Get(k); actual != expected {
+			t.Fatalf("%s: got wrong value, expected != actual: %q != %q", k, expected, actual)
+		}
+	}
+}
+
+// BenchmarkMiddleware measures the per-request overhead of the middleware
+// around a handler that does nothing. Most of it is the request context
+// and ResponseWriter wrapping. Keep the figures in the README up to date
+// when this changes.
+func BenchmarkMiddleware(b *testing.B) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rec, r)
+	}
+}
+
+// BenchmarkMiddleware_metric is the same as BenchmarkMiddleware but also
+// records and writes a single metric.
+func BenchmarkMiddleware_metric(b *testing.B) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Start().Stop()
+		w.WriteHeader(http.StatusOK)
+	}), nil)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func TestMiddleware_unwrapped(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Opts    *MiddlewareOpts
+		Wrapped bool
+	}{
+		{"nil opts", nil, true},
+		{"disable headers", &MiddlewareOpts{DisableHeaders: true}, false},
+		{"disable headers with body write", &MiddlewareOpts{DisableHeaders: true, CaptureBodyWrite: true}, true},
+		{"disallowed origin", &MiddlewareOpts{AllowOrigins: []string{"https://example.com"}}, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Origin", "https://other.com")
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if wrapped := w != http.ResponseWriter(rec); wrapped != tt.Wrapped {
+					t.Fatalf("expected wrapped: %v", tt.Wrapped)
+				}
+				FromContext(r.Context()).NewMetric("sql").Start().Stop()
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(handler, tt.Opts).ServeHTTP(rec, r)
+
+			if tt.Opts != nil {
+				if actual := rec.Header().Get(HeaderKey); actual != "" {
+					t.Fatalf("expected no header, got: %q", actual)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMiddleware_disableHeaders is the same as
+// BenchmarkMiddleware_metric but with headers disabled, which doesn't
+// need to wrap the ResponseWriter.
+func BenchmarkMiddleware_disableHeaders(b *testing.B) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Start().Stop()
+		w.WriteHeader(http.StatusOK)
+	}), &MiddlewareOpts{DisableHeaders: true})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func TestMiddleware_allowOrigins(t *testing.T) {
+	cases := []struct {
+		Name              string
+		AllowOrigins      []string
+		Origin            string
+		Expected          bool
+		TimingAllowOrigin string
+	}{
+		{
+			"no origin",
+			[]string{"https://example.com"},
+			"",
+			true,
+			"",
+		},
+
+		{
+			"allowed origin",
+			[]string{"https://other.com", "https://example.com"},
+			"https://example.com",
+			true,
+			"https://example.com",
+		},
+
+		{
+			"disallowed origin",
+			[]string{"https://example.com"},
+			"https://evil.com",
+			false,
+			"",
+		},
+
+		{
+			"wildcard",
+			[]string{"*"},
+			"https://anything.com",
+			true,
+			"https://anything.com",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.Origin != "" {
+				r.Header.Set("Origin", tt.Origin)
+			}
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+				w.WriteHeader(responseStatus)
+			})
+
+			opts := &MiddlewareOpts{AllowOrigins: tt.AllowOrigins}
+			Middleware(handler, opts).ServeHTTP(rec, r)
+
+			_, present := map[string][]string(rec.Header())[HeaderKey]
+			if present != tt.Expected {
+				t.Fatalf("expected header to be present: %v", tt.Expected)
+			}
+			if actual := rec.Header().Get(TimingAllowOriginKey); actual != tt.TimingAllowOrigin {
+				t.Fatalf("got wrong Timing-Allow-Origin, expected != actual: %q != %q", tt.TimingAllowOrigin, actual)
+			}
+			if actual := rec.Header()["Vary"]; !reflect.DeepEqual(actual, []string{"Origin"}) {
+				t.Fatalf("expected Vary to be Origin: %q", actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_allowOriginsNoMetrics(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(responseStatus)
+	})
+
+	opts := &MiddlewareOpts{AllowOrigins: []string{"https://example.com"}}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	// Timing-Allow-Origin is only sent along with the header
+	if actual := rec.Header().Get(TimingAllowOriginKey); actual != "" {
+		t.Fatalf("unexpected Timing-Allow-Origin: %q", actual)
+	}
+	if actual := rec.Header().Get("Vary"); actual != "Origin" {
+		t.Fatalf("expected Vary to be Origin: %q", actual)
+	}
+}
+
+func TestMiddleware_timingAllowOrigin(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Metrics  bool
+		Expected string
+	}{
+		{"with metrics", true, "*"},
+		{"without metrics", false, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.Metrics {
+					FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+				}
+			})
+
+			Middleware(handler, &MiddlewareOpts{TimingAllowOrigin: "*"}).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(TimingAllowOriginKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_captureBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("request"))
+	rec := httptest.NewRecorder()
+
+	var h *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{CaptureBodyRead: true, CaptureBodyWrite: true}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	// The body read happened before the header was written
+	actual := rec.Header().Get(HeaderKey)
+	if !strings.HasPrefix(actual, bodyReadMetricName) {
+		t.Fatalf("expected %q metric in header: %q", bodyReadMetricName, actual)
+	}
+	if strings.Contains(actual, bodyWriteMetricName) {
+		t.Fatalf("expected no %q metric in header: %q", bodyWriteMetricName, actual)
+	}
+
+	// Both should be recorded
+	var names []string
+	for _, m := range h.Metrics {
+		names = append(names, m.Name)
+	}
+	expected := []string{bodyReadMetricName, bodyWriteMetricName}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", names, expected)
+	}
+
+	if rec.Body.String() != responseBody {
+		t.Fatalf("body was modified: %q", rec.Body.String())
+	}
+}
+
+func TestMiddleware_captureBodyReadFrom(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+
+		// The LimitReader keeps the ResponseWriter from sending a file
+		// directly, but io.Copy still uses ReadFrom instead of Write.
+		src := io.LimitReader(strings.NewReader(responseBody), int64(len(responseBody)))
+		if _, err := io.Copy(w, src); err != nil {
+			t.Error(err)
+		}
+	})
+
+	names := make(chan []string, 1)
+	opts := &MiddlewareOpts{
+		CaptureBodyWrite: true,
+		OnComplete: func(r *http.Request, h *Header) {
+			var result []string
+			for _, m := range h.Metrics {
+				result = append(result, m.Name)
+			}
+			names <- result
+		},
+	}
+
+	ts := httptest.NewServer(Middleware(handler, opts))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := res.Header.Get(HeaderKey); actual != "sql;dur=10" {
+		t.Fatalf("bad header: %q", actual)
+	}
+	if string(body) != responseBody {
+		t.Fatalf("body was modified: %q", body)
+	}
+
+	expected := []string{"sql", bodyWriteMetricName}
+	if actual := <-names; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", actual, expected)
+	}
+}
+
+func TestMiddleware_captureBodyUnused(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("request"))
+	rec := httptest.NewRecorder()
+
+	var h *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h = FromContext(r.Context())
+	})
+
+	opts := &MiddlewareOpts{CaptureBodyRead: true, CaptureBodyWrite: true}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	if len(h.Metrics) != 0 {
+		t.Fatalf("expected no metrics: %#v", h.Metrics)
+	}
+}
+
+func TestMiddleware_contextKey(t *testing.T) {
+	type customKey struct{}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContextWithKey(r.Context(), customKey{})
+		if h == nil {
+			t.Fatal("expected *Header to be present under the custom key")
+		}
+		if h != FromContext(r.Context()) {
+			t.Fatal("expected FromContext to return the same *Header")
+		}
+
+		h.NewMetric("sql").Duration = 10 * time.Millisecond
+	})
+
+	Middleware(handler, &MiddlewareOpts{ContextKey: customKey{}}).ServeHTTP(rec, r)
+
+	expected := "sql;dur=10"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_deterministic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("b").WithExtra("z", "1").WithExtra("y", "2").WithExtra("x", "3")
+		h.NewMetric("a").WithExtra("c", "1").WithExtra("b", "2").WithExtra("a", "3")
+		h.NewMetric("c")
+	})
+	mw := Middleware(handler, &MiddlewareOpts{Deterministic: true})
+
+	expected := `a;a=3;b=2;c=1,b;x=3;y=2;z=1,c`
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		mw.ServeHTTP(rec, r)
+
+		if actual := rec.Header().Get(HeaderKey); actual != expected {
+			t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+		}
+	}
+}
+
+func TestMiddleware_sortByStop(t *testing.T) {
+	cur := time.Unix(0, 0)
+	setNow(t, func() time.Time { return cur })
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.AddDuration("external", 5*time.Millisecond)
+		outer := h.NewMetric("outer").Start()
+		inner := h.NewMetric("inner").Start()
+		cur = cur.Add(10 * time.Millisecond)
+		inner.Stop()
+		cur = cur.Add(10 * time.Millisecond)
+		outer.Stop()
+		h.NewMetric("sql").WithInterval(time.Unix(0, 0), cur.Add(-15*time.Millisecond))
+	})
+
+	Middleware(handler, &MiddlewareOpts{SortByStop: true}).ServeHTTP(rec, r)
+
+	expected := "outer;dur=20,inner;dur=10,sql;dur=5,external;dur=5"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_timeline(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var recorded *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded = FromContext(r.Context())
+		recorded.AddDuration("external", 5*time.Millisecond)
+
+		time.Sleep(20 * time.Millisecond)
+		m := recorded.NewMetric("sql").Start()
+		time.Sleep(5 * time.Millisecond)
+		m.Stop()
+	})
+
+	Middleware(handler, &MiddlewareOpts{Timeline: true}).ServeHTTP(rec, r)
+
+	h, err := ParseHeader(rec.Header().Get(HeaderKey))
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+	if len(h.Metrics) != 2 {
+		t.Fatalf("expected two metrics: %#v", h.Metrics)
+	}
+
+	// A metric that wasn't started has no start offset
+	if _, ok := h.Metrics[0].Extra[paramNameStart]; ok {
+		t.Fatalf("expected no start param: %#v", h.Metrics[0])
+	}
+
+	start, err := strconv.ParseFloat(h.Metrics[1].Extra[paramNameStart], 64)
+	if err != nil {
+		t.Fatalf("error parsing start: %s", err)
+	}
+	if start < 15 || start > 100 {
+		t.Fatalf("start should be about 20ms: %v", start)
+	}
+
+	// The recorded metrics are not modified
+	if _, ok := recorded.Metrics[1].Extra[paramNameStart]; ok {
+		t.Fatal("recorded metric should not be modified")
+	}
+}
+
+func TestMiddleware_http2(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Handler func(w http.ResponseWriter)
+	}{
+		{
+			"write header",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(responseStatus)
+				w.Write([]byte(responseBody))
+			},
+		},
+
+		{
+			"write without header",
+			func(w http.ResponseWriter) {
+				w.Write([]byte(responseBody))
+			},
+		},
+
+		{
+			"no write",
+			func(w http.ResponseWriter) {},
+		},
+
+		{
+			"flush",
+			func(w http.ResponseWriter) {
+				w.Write([]byte(responseBody))
+				w.(http.Flusher).Flush()
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+				tt.Handler(w)
+			}), nil))
+			ts.EnableHTTP2 = true
+			ts.StartTLS()
+			defer ts.Close()
+
+			res, err := ts.Client().Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.ProtoMajor != 2 {
+				t.Fatalf("expected HTTP/2, got: %s", res.Proto)
+			}
+
+			expected := "sql;dur=10"
+			if actual := res.Header.Get(HeaderKey); actual != expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_httpError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	Middleware(handler, nil).ServeHTTP(rec, r)
+
+	expected := "sql;dur=10"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("bad status: %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "boom\n" {
+		t.Fatalf("bad body: %q", body)
+	}
+}
+
+func TestMiddleware_logWriter(t *testing.T) {
+	var buf bytes.Buffer
+	mw := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			return
+		}
+
+		h := FromContext(r.Context())
+		h.AddDuration("sql", 10500*time.Microsecond)
+		h.AddDuration("cache", 200*time.Microsecond)
+	}), &MiddlewareOpts{LogWriter: &buf})
+
+	for _, path := range []string{"/users", "/empty"} {
+		mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	expected := "GET /users sql=10.5ms cache=0.2ms\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+}
+
+func TestMiddleware_logWriterConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	mw := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).AddDuration("sql", time.Millisecond)
+	}), &MiddlewareOpts{LogWriter: &buf})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+
+	expected := strings.Repeat("GET / sql=1ms\n", 50)
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+}
+
+func TestMiddleware_recordOnPanic(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+		panic("secret details")
+	})
+
+	var reported string
+	opts := &MiddlewareOpts{
+		RecordOnPanic: true,
+		OnComplete: func(r *http.Request, h *Header) {
+			reported = h.String()
+		},
+	}
+
+	// An outer handler that recovers and writes an error response
+	mw := Middleware(handler, opts)
+	recoverer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != "secret details" {
+				t.Fatalf("expected panic to continue, got: %v", v)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+
+		mw.ServeHTTP(w, r)
+	})
+	recoverer.ServeHTTP(rec, r)
+
+	expected := "sql;dur=10,panic"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("bad status: %d", rec.Code)
+	}
+
+	// Only the non-public outputs describe the panic
+	expected = `sql;dur=10,panic;desc="secret details"`
+	if reported != expected {
+		t.Fatalf("got wrong reported value, expected != actual: %q != %q", expected, reported)
+	}
+}
+
+func TestPanicDesc(t *testing.T) {
+	cases := []struct {
+		Value    interface{}
+		Expected string
+	}{
+		{"boom", "boom"},
+		{fmt.Errorf("line 1\nline 2"), "line 1 line 2"},
+		{strings.Repeat("é", 70), strings.Repeat("é", 64) + "..."},
+	}
+
+	for _, tt := range cases {
+		if actual := panicDesc(tt.Value); actual != tt.Expected {
+			t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+		}
+	}
+}
+
+func TestMiddleware_base64Header(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("sql").WithDesc("a;b").Duration = 1263 * time.Microsecond
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{Base64Header: "X-Timing-B64"}
+	opts.Digits = 1
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	if actual := rec.Header().Get(HeaderKey); actual != `sql;desc="a;b";dur=1.3` {
+		t.Fatalf("bad: %q", actual)
+	}
+
+	h, err := DecodeB64Header(rec.Header().Get("X-Timing-B64"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(h.Metrics) != 1 || h.Metrics[0].Duration != 1263*time.Microsecond || h.Metrics[0].Desc != "a;b" {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+}
+
+func TestMiddleware_skipRunning(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var running *Metric
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := FromContext(r.Context())
+		h.NewMetric("sql").Start().Stop().Duration = 10 * time.Millisecond
+		running = h.NewMetric("stream").Start()
+		w.WriteHeader(http.StatusOK)
+		running.Stop()
+	})
+
+	var complete []*Metric
+	opts := &MiddlewareOpts{
+		SkipRunning: true,
+		Timeline:    true,
+		OnComplete: func(r *http.Request, h *Header) {
+			complete = h.Clone().Metrics
+		},
+	}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	actual := rec.Header().Get(HeaderKey)
+	if !strings.HasPrefix(actual, "sql;dur=10;start=") || strings.Contains(actual, "stream") {
+		t.Fatalf("bad: %q", actual)
+	}
+
+	// The running metric is still recorded and the recorded metrics
+	// don't get the params added for the header.
+	if len(complete) != 2 || complete[1].Name != "stream" || !complete[1].Measured() {
+		t.Fatalf("bad: %#v", complete)
+	}
+	if len(complete[0].Extra) != 0 {
+		t.Fatalf("recorded metric should not be modified: %#v", complete[0])
+	}
+}
+
+func TestMiddleware_skipRunningAll(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric("stream").Start()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	Middleware(handler, &MiddlewareOpts{SkipRunning: true, Version: "v1"}).ServeHTTP(rec, r)
+
+	if _, present := map[string][]string(rec.Header())[HeaderKey]; present {
+		t.Fatalf("header should not be present: %q", rec.Header().Get(HeaderKey))
+	}
+}
+
+func TestMiddleware_now(t *testing.T) {
+	cur := time.Unix(0, 0)
+	setNow(t, func() time.Time { return cur })
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur = cur.Add(10 * time.Millisecond)
+		m := FromContext(r.Context()).NewMetric("sql").Start()
+		cur = cur.Add(25 * time.Millisecond)
+		m.Stop()
+		cur = cur.Add(65 * time.Millisecond)
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{
+		Timeline:   true,
+		Percent:    true,
+		EncodeOpts: EncodeOpts{SortExtra: true},
+	}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "sql;dur=25;pct=25.0;start=10"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_nestedTimelinePercent(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Inner    *MiddlewareOpts
+		Outer    *MiddlewareOpts
+		Expected string
+	}{
+		{
+			"outer",
+			nil,
+			&MiddlewareOpts{Timeline: true},
+			"sql;dur=25;start=10",
+		},
+
+		{
+			"inner",
+			&MiddlewareOpts{Timeline: true},
+			nil,
+			"sql;dur=25",
+		},
+
+		{
+			"outer percent",
+			nil,
+			&MiddlewareOpts{Percent: true},
+			"sql;dur=25;pct=25.0",
+		},
+
+		{
+			"inner percent",
+			&MiddlewareOpts{Percent: true},
+			nil,
+			"sql;dur=25",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			cur := time.Unix(0, 0)
+			setNow(t, func() time.Time { return cur })
+
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cur = cur.Add(10 * time.Millisecond)
+				m := FromContext(r.Context()).NewMetric("sql").Start()
+				cur = cur.Add(25 * time.Millisecond)
+				m.Stop()
+				cur = cur.Add(65 * time.Millisecond)
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(Middleware(handler, tt.Inner), tt.Outer).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_legendHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	var recorded *Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded = FromContext(r.Context())
+		recorded.NewMetric("database-query").WithDesc("MySQL").Duration = 10 * time.Millisecond
+		recorded.AddDuration("cache-lookup", time.Millisecond)
+		recorded.AddDuration("database-query", 5*time.Millisecond)
+		w.Write([]byte(responseBody))
+	})
+
+	opts := &MiddlewareOpts{LegendHeader: "Server-Timing-Legend"}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	expected := "0;desc=MySQL;dur=10,1;dur=1,0;dur=5"
+	if actual := rec.Header().Get(HeaderKey); actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+
+	legend := rec.Header().Get("Server-Timing-Legend")
+	if expected := `{"0":"database-query","1":"cache-lookup"}`; legend != expected {
+		t.Fatalf("got wrong legend, expected != actual: %q != %q", expected, legend)
+	}
+
+	// The recorded metrics keep their names and the client can restore
+	// them from the legend.
+	h, err := ParseHeader(rec.Header().Get(HeaderKey))
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+	if err := h.ApplyLegend(legend); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if h.String() != recorded.String() {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", h.String(), recorded.String())
+	}
+}
+
+func TestMiddleware_captureStatus(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Handler  func(http.ResponseWriter)
+		Expected string
+	}{
+		{
+			"explicit status",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			"request;class=5xx;method=GET,sql;dur=10",
+		},
+
+		{
+			"implicit status on write",
+			func(w http.ResponseWriter) {
+				w.Write([]byte(responseBody))
+			},
+			"request;class=2xx;method=GET,sql;dur=10",
+		},
+
+		{
+			"implicit status without write",
+			func(w http.ResponseWriter) {},
+			"request;class=2xx;method=GET,sql;dur=10",
+		},
+
+		{
+			"not found",
+			func(w http.ResponseWriter) {
+				http.NotFound(w, nil)
+			},
+			"request;class=4xx;method=GET,sql;dur=10",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+				tt.Handler(w)
+			})
+
+			opts := &MiddlewareOpts{
+				CaptureRoute:  true,
+				CaptureStatus: true,
+				EncodeOpts:    EncodeOpts{SortExtra: true},
+			}
+			Middleware(handler, opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_captureStatusWithoutRoute(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	rec := httptest.NewRecorder()
+	Middleware(handler, &MiddlewareOpts{CaptureStatus: true}).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if actual, expected := rec.Header().Get(HeaderKey), "sql;dur=10"; actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_captureRoute(t *testing.T) {
+	cases := []struct {
+		Name      string
+		RouteFunc func(*http.Request) string
+		Expected  string
+	}{
+		{
+			"no route func",
+			nil,
+			`request;method=GET,sql;dur=10`,
+		},
+
+		{
+			"route func",
+			func(*http.Request) string { return "/users/{id}" },
+			`request;method=GET;route="/users/{id}",sql;dur=10`,
+		},
+
+		{
+			"empty route",
+			func(*http.Request) string { return "" },
+			`request;method=GET,sql;dur=10`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users/42", nil)
+			rec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+			})
+
+			opts := &MiddlewareOpts{
+				CaptureRoute: true,
+				RouteFunc:    tt.RouteFunc,
+				EncodeOpts:   EncodeOpts{SortExtra: true},
+			}
+			Middleware(handler, opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestMiddleware_captureCold(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+	})
+	opts := &MiddlewareOpts{
+		CaptureRoute: true,
+		CaptureCold:  true,
+		EncodeOpts:   EncodeOpts{SortExtra: true},
+	}
+
+	ts := httptest.NewUnstartedServer(Middleware(handler, opts))
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	get := func(client *http.Client) string {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get(HeaderKey)
+	}
+
+	// The second request reuses the connection of the first
+	client := ts.Client()
+	for i, expected := range []string{"request;cold=true;method=GET,sql;dur=10", "request;method=GET,sql;dur=10"} {
+		if actual := get(client); actual != expected {
+			t.Fatalf("%d: got wrong value, expected != actual: %q != %q", i, expected, actual)
+		}
+	}
+
+	// A new connection is cold again
+	client.CloseIdleConnections()
+	if actual, expected := get(client), "request;cold=true;method=GET,sql;dur=10"; actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+func TestMiddleware_captureColdNoConnContext(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+	})
+	opts := &MiddlewareOpts{CaptureRoute: true, CaptureCold: true}
+
+	rec := httptest.NewRecorder()
+	Middleware(handler, opts).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if actual, expected := rec.Header().Get(HeaderKey), "request;method=GET,sql;dur=10"; actual != expected {
+		t.Fatalf("got wrong value, expected != actual: %q != %q", expected, actual)
+	}
+}
+
+// namedHandler is a handler function with a known name for
+// TestMiddleware_captureHandlerName.
+func namedHandler(w http.ResponseWriter, r *http.Request) {
+	FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+}
+
+// namedHandlerType is a handler that isn't an http.HandlerFunc.
+type namedHandlerType struct{}
+
+func (namedHandlerType) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namedHandler(w, r)
+}
+
+func TestMiddleware_captureHandlerName(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Handler  http.Handler
+		Expected string
+	}{
+		{
+			"handler func",
+			http.HandlerFunc(namedHandler),
+			`request;desc="github.com/mitchellh/go-server-timing.namedHandler";method=GET,sql;dur=10`,
+		},
+
+		{
+			"handler type",
+			namedHandlerType{},
+			`request;desc=servertiming.namedHandlerType;method=GET,sql;dur=10`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			opts := &MiddlewareOpts{CaptureRoute: true, CaptureHandlerName: true}
+			Middleware(tt.Handler, opts).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+		})
+	}
+}
+
+// allocSink keeps allocations in tests from being optimized away.
+var allocSink []byte
+
+func TestMiddleware_captureRuntime(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).AddDuration("sql", 10*time.Millisecond)
+		allocSink = make([]byte, 1<<20)
+	})
+
+	opts := &MiddlewareOpts{CaptureGoroutines: true, CaptureAllocs: true}
+	Middleware(handler, opts).ServeHTTP(rec, r)
+
+	h, err := ParseHeader(rec.Header().Get(HeaderKey))
+	if err != nil {
+		t.Fatalf("error parsing header: %s", err)
+	}
+	if len(h.Metrics) != 3 || h.Metrics[1].Name != "goroutines" || h.Metrics[2].Name != "allocs" {
+		t.Fatalf("bad metrics: %#v", h.Metrics)
+	}
+
+	if n, _ := strconv.Atoi(h.Metrics[1].Extra["num"]); n < 1 {
+		t.Fatalf("bad goroutines: %#v", h.Metrics[1])
+	}
+
+	allocs := h.Metrics[2]
+	if n, _ := strconv.Atoi(allocs.Extra["num"]); n < 1 {
+		t.Fatalf("bad allocs: %#v", allocs)
+	}
+	if n, _ := strconv.Atoi(allocs.Extra["bytes"]); n < 1<<20 {
+		t.Fatalf("bad allocated bytes: %#v", allocs)
+	}
+}
+
+func TestMiddleware_detectSharedHeader(t *testing.T) {
+	opts := &MiddlewareOpts{DetectSharedHeader: true}
+
+	// Capture the *Header of the first request
+	var shared *Header
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shared = FromContext(r.Context())
+	}), opts).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Nesting within the same request is fine
+	inner := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), opts)
+	Middleware(inner, opts).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Installing the captured *Header into another request is detected
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatal("expected panic")
+		}
+		if !strings.Contains(fmt.Sprint(v), "GET /other") {
+			t.Fatalf("bad panic: %v", v)
+		}
+	}()
+
+	r := httptest.NewRequest("GET", "/other", nil)
+	r = r.WithContext(NewContext(r.Context(), shared))
+	inner.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMiddleware_captureETag(t *testing.T) {
+	cases := []struct {
+		Name     string
+		ETag     string
+		Expected string
+	}{
+		{
+			"with etag",
+			`"abc123"`,
+			`sql;dur=10,etag;desc="\"abc123\""`,
+		},
+
+		{
+			"without etag",
+			"",
+			`sql;dur=10`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			rec := httptest.NewRecorder()
+
+			var h *Header
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h = FromContext(r.Context())
+				h.NewMetric("sql").Duration = 10 * time.Millisecond
+				if tt.ETag != "" {
+					w.Header().Set("ETag", tt.ETag)
+				}
+				w.Write([]byte(responseBody))
+			})
+
+			Middleware(handler, &MiddlewareOpts{CaptureETag: true}).ServeHTTP(rec, r)
+
+			if actual := rec.Header().Get(HeaderKey); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %q != %q", tt.Expected, actual)
+			}
+
+			// The synthetic metric should not be recorded
+			for _, m := range h.Metrics {
+				if m.Name == etagMetricName {
+					t.Fatal("etag metric should not be in the recorded metrics")
+				}
+			}
+		})
+	}
+}
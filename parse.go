@@ -0,0 +1,168 @@
+package servertiming
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMetric parses a single server-timing-metric value into the metric
+// name and its params. The param names are lowercased since they're
+// case-insensitive. The metric name is returned as-is.
+//
+// Params without a value, such as "cached" in "sql;cached;dur=5", are
+// treated as flags and stored with an empty value. If a param is repeated,
+// only the first value is used as specified. Parsing stops at the first
+// malformed param, keeping everything parsed up to that point.
+func parseMetric(s string) (name string, params map[string]string) {
+	params = make(map[string]string)
+	name, s = expectToken(skipSpace(s))
+	if name == "" {
+		return
+	}
+
+	for {
+		s = skipSpace(s)
+		if !strings.HasPrefix(s, ";") {
+			return
+		}
+
+		var key string
+		key, s = expectToken(skipSpace(s[1:]))
+		if key == "" {
+			return
+		}
+		key = strings.ToLower(key)
+
+		// A param without a value is a flag
+		value := ""
+		s = skipSpace(s)
+		if strings.HasPrefix(s, "=") {
+			var ok bool
+			value, s, ok = expectTokenOrQuoted(skipSpace(s[1:]))
+			if !ok {
+				return
+			}
+		}
+
+		if _, ok := params[key]; !ok {
+			params[key] = value
+		}
+	}
+}
+
+// parseDuration parses the value of a "dur" param. A bare number is in
+// milliseconds as specified. As a courtesy to non-compliant senders, a
+// number followed by a unit suffix such as "ms" or "us" is parsed using
+// that unit.
+//
+// Durations too large for a time.Duration are clamped to the maximum
+// duration rather than overflowing. Negative durations are an error.
+func parseDuration(v string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if n := len(v); n > 0 && !('0' <= v[n-1] && v[n-1] <= '9') && v[n-1] != '.' {
+		d, err = time.ParseDuration(v)
+	} else {
+		d, err = time.ParseDuration(v + "ms")
+
+		// ParseDuration fails on overflow, so check if that is why
+		if err != nil {
+			if f, ferr := strconv.ParseFloat(v, 64); ferr == nil && f*float64(time.Millisecond) >= math.MaxInt64 {
+				return time.Duration(math.MaxInt64), nil
+			}
+		}
+	}
+
+	if err == nil && d < 0 {
+		return 0, fmt.Errorf("negative duration: %s", v)
+	}
+
+	return d, err
+}
+
+// skipSpace returns s with leading whitespace removed.
+func skipSpace(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+// expectToken returns the RFC7230 token at the start of s and the
+// remainder of s. If s doesn't start with a token, token is empty.
+func expectToken(s string) (token, rest string) {
+	i := 0
+	for ; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			break
+		}
+	}
+
+	return s[:i], s[i:]
+}
+
+// expectTokenOrQuoted returns the token or unescaped quoted-string at the
+// start of s and the remainder of s. ok is false if s starts with neither
+// or if a quoted-string is not terminated.
+func expectTokenOrQuoted(s string) (value, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		value, rest = expectToken(s)
+		return value, rest, value != ""
+	}
+
+	var b strings.Builder
+	escape := false
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escape:
+			escape = false
+			b.WriteByte(c)
+		case c == '\\':
+			escape = true
+		case c == '"':
+			return b.String(), s[i+1:], true
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", false
+}
+
+// isTokenChar reports whether c is a valid RFC7230 "tchar".
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isToken reports whether s is a valid RFC7230 "token".
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isQuotable reports whether s can be sent as an RFC7230 "quoted-string".
+// Every byte is allowed except control characters other than tab.
+func isQuotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,148 @@
+package servertiming
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMetric(t *testing.T) {
+	cases := []struct {
+		Input  string
+		Name   string
+		Params map[string]string
+	}{
+		{
+			"",
+			"",
+			map[string]string{},
+		},
+
+		{
+			"sql",
+			"sql",
+			map[string]string{},
+		},
+
+		{
+			"SQL-1",
+			"SQL-1",
+			map[string]string{},
+		},
+
+		{
+			`sql;dur=5;desc="a \"quoted\" value"`,
+			"sql",
+			map[string]string{"dur": "5", "desc": `a "quoted" value`},
+		},
+
+		{
+			"sql ; DUR = 5 ; cached",
+			"sql",
+			map[string]string{"dur": "5", "cached": ""},
+		},
+
+		{
+			`sql;desc=""`,
+			"sql",
+			map[string]string{"desc": ""},
+		},
+
+		{
+			"sql;dur=5;dur=10",
+			"sql",
+			map[string]string{"dur": "5"},
+		},
+
+		{
+			`sql;dur=5;desc="unterminated`,
+			"sql",
+			map[string]string{"dur": "5"},
+		},
+
+		{
+			`sql;dur=5;;desc=a`,
+			"sql",
+			map[string]string{"dur": "5"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Input, func(t *testing.T) {
+			name, params := parseMetric(tt.Input)
+			if name != tt.Name {
+				t.Fatalf("received, expected:\n\n%q\n\n%q", name, tt.Name)
+			}
+			if !reflect.DeepEqual(params, tt.Params) {
+				t.Fatalf("received, expected:\n\n%#v\n\n%#v", params, tt.Params)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected time.Duration
+		Err      bool
+	}{
+		{"5", 5 * time.Millisecond, false},
+		{"5.5", 5500 * time.Microsecond, false},
+		{"5.", 5 * time.Millisecond, false},
+		{"5ms", 5 * time.Millisecond, false},
+		{"5000us", 5 * time.Millisecond, false},
+		{"5000µs", 5 * time.Millisecond, false},
+		{"2s", 2 * time.Second, false},
+		{"100ns", 100 * time.Nanosecond, false},
+		{"99999999999999999999", time.Duration(math.MaxInt64), false},
+		{"9223372036854.775807", time.Duration(math.MaxInt64), false},
+		{"-5", 0, true},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"5parsecs", 0, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Input, func(t *testing.T) {
+			actual, err := parseDuration(tt.Input)
+			if (err != nil) != tt.Err {
+				t.Fatalf("expected error: %v, got: %v", tt.Err, err)
+			}
+			if actual != tt.Expected {
+				t.Fatalf("received, expected:\n\n%s\n\n%s", actual, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestIsToken(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected bool
+	}{
+		{"", false},
+		{"sql", true},
+		{"SQL-1", true},
+		{"10.5", true},
+		{"!#$%&'*+-.^_`|~", true},
+		{"a b", false},
+		{"a,b", false},
+		{"a;b", false},
+		{"a=b", false},
+		{`"a"`, false},
+		{"a\\b", false},
+		{"(a)", false},
+		{"a/b", false},
+		{"a\tb", false},
+		{"é", false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Input, func(t *testing.T) {
+			if actual := isToken(tt.Input); actual != tt.Expected {
+				t.Fatalf("got wrong value, expected != actual: %v != %v", tt.Expected, actual)
+			}
+		})
+	}
+}
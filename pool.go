@@ -0,0 +1,37 @@
+package servertiming
+
+import (
+	"sync"
+)
+
+// metricPool is the pool of metrics used by AcquireMetric and
+// ReleaseMetric.
+var metricPool = sync.Pool{
+	New: func() interface{} { return new(Metric) },
+}
+
+// AcquireMetric returns a Metric with the given name from a pool of
+// metrics. This can reduce allocations for applications that record many
+// metrics. The metric should be returned with ReleaseMetric once it is no
+// longer used, such as after the header has been written.
+func AcquireMetric(name string) *Metric {
+	m := metricPool.Get().(*Metric)
+	m.Name = name
+	return m
+}
+
+// ReleaseMetric resets the metric and returns it to the pool used by
+// AcquireMetric.
+//
+// The metric must not be used in any way after it is released, including
+// by a Header it was added to, since it may be handed out again by
+// AcquireMetric at any time. Using a released metric results in metrics
+// that mix data from unrelated operations.
+func ReleaseMetric(m *Metric) {
+	if m == nil {
+		return
+	}
+
+	m.Reset()
+	metricPool.Put(m)
+}
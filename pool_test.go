@@ -0,0 +1,82 @@
+package servertiming
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAcquireMetric(t *testing.T) {
+	m := AcquireMetric("sql")
+	if m.Name != "sql" {
+		t.Fatalf("bad name: %q", m.Name)
+	}
+
+	m.WithDesc("desc").WithExtra("k", "v").Start().Stop()
+	m.Count = 2
+	ReleaseMetric(m)
+
+	// Whatever we get back must be reset, whether or not it is the same
+	// metric we released.
+	m = AcquireMetric("cache")
+	if m.Name != "cache" || m.Desc != "" || m.Duration != 0 || m.Count != 0 ||
+		m.Extra != nil || !m.startTime.IsZero() || !m.stopTime.IsZero() {
+		t.Fatalf("metric was not reset: %#v", m)
+	}
+}
+
+func TestReleaseMetric_nil(t *testing.T) {
+	ReleaseMetric(nil)
+}
+
+// TestMetricPool_concurrent stresses acquire/use/release cycles from many
+// goroutines. This is mostly useful with the race detector enabled.
+func TestMetricPool_concurrent(t *testing.T) {
+	var h Header
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m := AcquireMetric("sql").Start()
+				m.WithExtra("k", "v").Stop()
+				if m.Name != "sql" {
+					t.Errorf("bad name: %q", m.Name)
+				}
+
+				// Encode a copy the same way the middleware would
+				h.Add(m)
+				h.Lock()
+				_ = h.clone().String()
+				h.Metrics = nil
+				h.Unlock()
+
+				ReleaseMetric(m)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// TestMetric_resetConcurrent resets a metric while another goroutine is
+// still timing it. This is mostly useful with the race detector enabled.
+func TestMetric_resetConcurrent(t *testing.T) {
+	m := AcquireMetric("sql")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.Start().Stop()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		m.Reset()
+	}
+	wg.Wait()
+
+	ReleaseMetric(m)
+}
@@ -0,0 +1,82 @@
+package servertiming
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecentHeaders keeps a copy of the *Header of the most recent requests
+// handled by a Middleware. Set it as MiddlewareOpts.Recent to record them.
+// This allows the timings of recent requests to be inspected from within
+// the process, such as from a debug endpoint.
+//
+// Only a fixed number of headers is kept so memory use is bounded. It is
+// safe for concurrent use.
+type RecentHeaders struct {
+	mu       sync.Mutex
+	requests []recentRequest
+	next     int
+}
+
+// recentRequest is a request recorded by RecentHeaders. The header is a
+// copy that is never modified once recorded.
+type recentRequest struct {
+	time   time.Time
+	method string
+	path   string
+	h      *Header
+}
+
+// NewRecentHeaders returns a RecentHeaders that keeps the headers of the
+// last n requests. n must be positive.
+func NewRecentHeaders(n int) *RecentHeaders {
+	if n <= 0 {
+		panic("servertiming: NewRecentHeaders requires a positive n")
+	}
+
+	return &RecentHeaders{requests: make([]recentRequest, 0, n)}
+}
+
+// Headers returns the recorded headers, oldest first. The headers are
+// copies so they can be read and modified freely.
+func (r *RecentHeaders) Headers() []*Header {
+	requests := r.all()
+	result := make([]*Header, len(requests))
+	for i, req := range requests {
+		result[i] = req.h.Clone()
+	}
+
+	return result
+}
+
+// all returns the recorded requests, oldest first.
+func (r *RecentHeaders) all() []recentRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]recentRequest, 0, len(r.requests))
+	result = append(result, r.requests[r.next:]...)
+	return append(result, r.requests[:r.next]...)
+}
+
+// add records a copy of h for the request req, replacing the oldest
+// request if it is full.
+func (r *RecentHeaders) add(req *http.Request, h *Header) {
+	recent := recentRequest{
+		time:   now(),
+		method: req.Method,
+		path:   req.URL.Path,
+		h:      h.Clone(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.requests) < cap(r.requests) {
+		r.requests = append(r.requests, recent)
+		return
+	}
+
+	r.requests[r.next] = recent
+	r.next = (r.next + 1) % len(r.requests)
+}
@@ -0,0 +1,56 @@
+package servertiming
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRecentHeaders(t *testing.T) {
+	recent := NewRecentHeaders(2)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).NewMetric(r.URL.Path[1:])
+	}), &MiddlewareOpts{Recent: recent})
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var names []string
+	for _, h := range recent.Headers() {
+		names = append(names, h.String())
+	}
+
+	expected := []string{"b", "c"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("received, expected:\n\n%#v\n\n%#v", names, expected)
+	}
+}
+
+func TestRecentHeaders_copies(t *testing.T) {
+	recent := NewRecentHeaders(1)
+
+	var h Header
+	m := h.NewMetric("sql")
+	recent.add(httptest.NewRequest("GET", "/", nil), &h)
+	m.Name = "changed"
+	h.NewMetric("later")
+
+	headers := recent.Headers()
+	headers[0].Metrics[0].Name = "modified"
+
+	if actual := recent.Headers()[0].String(); actual != "sql" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestNewRecentHeaders_invalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("should panic")
+		}
+	}()
+
+	NewRecentHeaders(0)
+}
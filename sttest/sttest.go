@@ -0,0 +1,91 @@
+// Package sttest provides helpers for asserting on the Server-Timing
+// headers sent by a service in integration tests.
+package sttest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+)
+
+// Update, if true, makes CompareGolden write the value it is given to the
+// golden file instead of comparing against it. This is usually set from a
+// test flag, such as:
+//
+//	var update = flag.Bool("update", false, "update golden files")
+//
+//	func TestMain(m *testing.M) {
+//		flag.Parse()
+//		sttest.Update = *update
+//		os.Exit(m.Run())
+//	}
+var Update = false
+
+// FromRecorder parses the Server-Timing headers written to rec. If there
+// are multiple headers, their metrics are combined in order. If there are
+// none, the returned *Header has no metrics.
+func FromRecorder(rec *httptest.ResponseRecorder) (*servertiming.Header, error) {
+	return servertiming.ParseHeader(strings.Join(rec.Header()[servertiming.HeaderKey], ","))
+}
+
+// Record returns a normalized representation of the Server-Timing headers
+// in resp that is suitable for comparing against a golden file.
+//
+// Each metric is on its own line, sorted by name, with its params in a
+// sorted order. Durations change from run to run so every measured
+// duration is replaced with "dur=0". This still records which metrics
+// have a duration without depending on how long they took.
+func Record(resp *http.Response) string {
+	h, err := servertiming.ParseHeader(strings.Join(resp.Header[servertiming.HeaderKey], ","))
+	if err != nil {
+		return ""
+	}
+
+	for _, m := range h.Metrics {
+		if m.Measured() {
+			m.Duration = 0
+			m.SetMeasured(true)
+		}
+	}
+
+	h.Sort(func(a, b *servertiming.Metric) bool {
+		return a.Name < b.Name
+	})
+
+	var b strings.Builder
+	opts := &servertiming.EncodeOpts{SortExtra: true}
+	for _, m := range h.Metrics {
+		b.WriteString(m.StringOpts(opts))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+// CompareGolden fails the test if got does not equal the contents of the
+// golden file at path. If Update is true, the golden file is written
+// instead.
+func CompareGolden(t testing.TB, got, path string) {
+	t.Helper()
+
+	if Update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("error writing golden file: %s", err)
+		}
+
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading golden file: %s", err)
+	}
+
+	if got != string(expected) {
+		t.Fatalf("%s: received, expected:\n\n%s\n\n%s", path, got, expected)
+	}
+}
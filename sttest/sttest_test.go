@@ -0,0 +1,95 @@
+package sttest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+)
+
+func TestFromRecorder(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servertiming.FromContext(r.Context()).NewMetric("sql").Duration = 10 * time.Millisecond
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	servertiming.Middleware(handler, nil).ServeHTTP(rec, r)
+	rec.Header().Add(servertiming.HeaderKey, "cdn;desc=edge")
+
+	h, err := FromRecorder(rec)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "sql;dur=10,cdn;desc=edge"
+	if actual := h.String(); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+}
+
+func TestFromRecorder_none(t *testing.T) {
+	h, err := FromRecorder(httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(h.Metrics) != 0 {
+		t.Fatalf("bad: %#v", h.Metrics)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := servertiming.FromContext(r.Context())
+		timing.NewMetric("sql").WithDesc("MySQL").Start().Stop()
+		timing.NewMetric("cache").
+			WithExtra("hit", "").
+			WithExtra("backend", "redis").
+			Duration = 5 * time.Millisecond
+		timing.NewMetric("region").WithDesc("us east")
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	servertiming.Middleware(handler, nil).ServeHTTP(rec, r)
+
+	CompareGolden(t, Record(rec.Result()), filepath.Join("testdata", "record.golden"))
+}
+
+func TestRecord_multipleHeaders(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add(servertiming.HeaderKey, "b;dur=10")
+	resp.Header.Add(servertiming.HeaderKey, "a;dur=0, c")
+
+	expected := "a;dur=0\nb;dur=0\nc\n"
+	if actual := Record(resp); actual != expected {
+		t.Fatalf("received, expected:\n\n%q\n\n%q", actual, expected)
+	}
+}
+
+func TestRecord_none(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if actual := Record(resp); actual != "" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestCompareGolden_update(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sttest")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "update.golden")
+
+	Update = true
+	CompareGolden(t, "sql;dur=0\n", path)
+	Update = false
+
+	CompareGolden(t, "sql;dur=0\n", path)
+}
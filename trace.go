@@ -0,0 +1,21 @@
+package servertiming
+
+import (
+	"context"
+	"runtime/trace"
+)
+
+// TraceRegion calls fn and records how long it took both as a
+// runtime/trace region and as a metric in the *Header in ctx. The region
+// type and the metric name are both name. This avoids instrumenting the
+// same code twice for applications that use the execution tracer as well.
+//
+// The metric is created with NewMetricFromContext, so tags set with
+// WithMetricTag are applied. If there is no *Header in ctx, only the
+// region is recorded.
+func TraceRegion(ctx context.Context, name string, fn func()) {
+	m := NewMetricFromContext(ctx, name).Start()
+	defer m.Stop()
+
+	trace.WithRegion(ctx, name, fn)
+}
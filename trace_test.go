@@ -0,0 +1,50 @@
+package servertiming
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTraceRegion(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	called := false
+	TraceRegion(ctx, "sql", func() {
+		called = true
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	if !called {
+		t.Fatal("fn should be called")
+	}
+	if len(h.Metrics) != 1 {
+		t.Fatalf("expected one metric: %#v", h.Metrics)
+	}
+	if m := h.Metrics[0]; m.Name != "sql" || m.Duration < 5*time.Millisecond {
+		t.Fatalf("bad metric: %#v", m)
+	}
+}
+
+func TestTraceRegion_panic(t *testing.T) {
+	var h Header
+	ctx := NewContext(context.Background(), &h)
+
+	func() {
+		defer func() { recover() }()
+		TraceRegion(ctx, "sql", func() { panic("boom") })
+	}()
+
+	if len(h.Metrics) != 1 || !h.Metrics[0].Measured() {
+		t.Fatalf("metric should be stopped: %#v", h.Metrics)
+	}
+}
+
+func TestTraceRegion_noHeader(t *testing.T) {
+	called := false
+	TraceRegion(context.Background(), "sql", func() { called = true })
+	if !called {
+		t.Fatal("fn should be called")
+	}
+}